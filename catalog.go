@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// catalogMetric is a metric the exporter can export.
+type catalogMetric struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// descPattern parses the fully-qualified name, help and variable labels out
+// of prometheus.Desc.String, which is the only way to read them back.
+var descPattern = regexp.MustCompile(`^Desc\{fqName: ("(?:[^"\\]|\\.)*"), help: ("(?:[^"\\]|\\.)*"), constLabels: \{.*\}, variableLabels: \[(.*)\]\}$`)
+
+// metricNamePattern matches the names of the metrics of the exporter in
+// PromQL expressions, as opposed to recording rules which contain colons.
+var metricNamePattern = regexp.MustCompile(`\b` + namespace + `_[a-zA-Z0-9_]*\b`)
+
+// metricCatalog lists the metrics the exporter can export by name, from the
+// descriptions of an exporter with every collector and feature enabled.
+func metricCatalog() (map[string]catalogMetric, error) {
+	e := NewExporter("", 0, true, log.NewNopLogger())
+	for name := range e.collectors {
+		e.collectors[name] = true
+	}
+	e.trackInfo = true
+	e.options = []string{"num-proxies"}
+	e.tko = newTKOTracker(0, nil)
+	e.samples = newLatencySampler(1.1, true, nil)
+
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		e.Describe(ch)
+		ch <- configDriftDesc
+		close(ch)
+	}()
+
+	catalog := make(map[string]catalogMetric)
+	var err error
+	for desc := range ch {
+		m, parseErr := parseDesc(desc)
+		if parseErr != nil {
+			err = parseErr
+			continue
+		}
+		catalog[m.name] = m
+	}
+	return catalog, err
+}
+
+// queryBuilder builds PromQL expressions from the metric catalog, and
+// remembers the metrics that are not in it.
+type queryBuilder struct {
+	catalog map[string]catalogMetric
+	unknown []string
+}
+
+// metric returns the name of a metric of the catalog.
+func (b *queryBuilder) metric(name string) string {
+	if _, ok := b.catalog[name]; !ok {
+		b.unknown = append(b.unknown, name)
+	}
+	return name
+}
+
+// err reports the metrics referenced by the expressions that are not in
+// the catalog.
+func (b *queryBuilder) err() error {
+	if len(b.unknown) == 0 {
+		return nil
+	}
+	sort.Strings(b.unknown)
+	return fmt.Errorf("reference metrics the exporter does not export: %s", strings.Join(b.unknown, ", "))
+}
+
+func parseDesc(desc *prometheus.Desc) (catalogMetric, error) {
+	match := descPattern.FindStringSubmatch(desc.String())
+	if match == nil {
+		return catalogMetric{}, fmt.Errorf("unexpected metric description %s", desc)
+	}
+	name, err := strconv.Unquote(match[1])
+	if err != nil {
+		return catalogMetric{}, err
+	}
+	help, err := strconv.Unquote(match[2])
+	if err != nil {
+		return catalogMetric{}, err
+	}
+	return catalogMetric{name: name, help: help, labels: strings.Fields(match[3])}, nil
+}
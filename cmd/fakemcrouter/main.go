@@ -0,0 +1,53 @@
+// Command fakemcrouter serves scripted mcrouter replies, with optional fault
+// injection, to demo or test mcrouter_exporter without a real mcrouter.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Dev25/mcrouter_exporter/internal/mcroutertest"
+)
+
+func main() {
+	var (
+		listenAddress   = flag.String("listen-address", "localhost:5000", "TCP address or UNIX socket path to listen on.")
+		script          = flag.String("script", "", "Script of commands and replies to serve (see testdata/*.script).")
+		latency         = flag.Duration("fault.latency", 0, "Delay every reply.")
+		disconnectAfter = flag.Int("fault.disconnect-after", 0, "Close connections after that many commands (0 never disconnects).")
+		garbage         = flag.Bool("fault.garbage", false, "Reply with garbage instead of the scripted replies.")
+		chunkSize       = flag.Int("fault.chunk-size", 0, "Split replies into writes of that many bytes (0 writes replies at once).")
+	)
+	flag.Parse()
+
+	if *script == "" {
+		fmt.Fprintln(os.Stderr, "-script is required")
+		os.Exit(1)
+	}
+	replies, err := mcroutertest.LoadScript(*script)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load script:", err)
+		os.Exit(1)
+	}
+
+	s, err := mcroutertest.NewServer(*listenAddress, replies)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to listen:", err)
+		os.Exit(1)
+	}
+	s.SetFaults(mcroutertest.Faults{
+		Latency:         *latency,
+		DisconnectAfter: *disconnectAfter,
+		Garbage:         *garbage,
+		ChunkSize:       *chunkSize,
+	})
+	fmt.Fprintf(os.Stdout, "Serving %d scripted commands on %s\n", len(replies), s.Addr())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	s.Close()
+}
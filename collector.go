@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default timeout of a collector, see -collector.<name>.timeout.
+const defaultCollectorTimeout = 5 * time.Second
+
+var (
+	collectorSuccessDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "collector_success"),
+		"Whether the collector succeeded during the last scrape.",
+		[]string{"collector"},
+		nil,
+	)
+	collectorDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "collector_duration_seconds"),
+		"Duration of the collector during the last scrape.",
+		[]string{"collector"},
+		nil,
+	)
+)
+
+// collector is an optional group of mcrouter stats. Collectors run
+// concurrently after stats all, each on its own connection and with its own
+// timeout.
+type collector interface {
+	// describe sends the descriptors of the metrics of the collector.
+	describe(ch chan<- *prometheus.Desc)
+	// commands lists the commands pipelined to mcrouter by the collector.
+	commands() []string
+	// update reads the replies to the commands, in order, and delivers the
+	// metrics. stats holds the result of stats all.
+	update(reader *bufio.Reader, stats map[string]string, ch chan<- prometheus.Metric) error
+}
+
+// collectorFactory builds the collector of an exporter, or returns nil when
+// the exporter is not configured for it to collect anything.
+type collectorFactory struct {
+	defaultEnabled bool
+	help           string
+	new            func(e *Exporter) collector
+}
+
+// collectorFactories holds the collectors by name, see registerCollector.
+var collectorFactories = make(map[string]collectorFactory)
+
+// registerCollector makes a collector available as -collector.<name>.
+func registerCollector(name string, defaultEnabled bool, help string, new func(e *Exporter) collector) {
+	collectorFactories[name] = collectorFactory{defaultEnabled: defaultEnabled, help: help, new: new}
+}
+
+// collectorNames lists the registered collectors in lexical order.
+func collectorNames() []string {
+	names := make([]string, 0, len(collectorFactories))
+	for name := range collectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// collectorFlags holds the -collector.<name> and -collector.<name>.timeout
+// flags of the registered collectors.
+type collectorFlags struct {
+	enabled  map[string]*bool
+	timeouts map[string]*time.Duration
+}
+
+// registerCollectorFlags defines the flags of every registered collector.
+func registerCollectorFlags(fs *flag.FlagSet) *collectorFlags {
+	f := &collectorFlags{
+		enabled:  make(map[string]*bool, len(collectorFactories)),
+		timeouts: make(map[string]*time.Duration, len(collectorFactories)),
+	}
+	for _, name := range collectorNames() {
+		factory := collectorFactories[name]
+		f.enabled[name] = fs.Bool("collector."+name, factory.defaultEnabled, factory.help)
+		f.timeouts[name] = fs.Duration("collector."+name+".timeout", defaultCollectorTimeout, fmt.Sprintf("Timeout of the %s collector.", name))
+	}
+	return f
+}
+
+// apply configures the collectors of an exporter from the flags.
+func (f *collectorFlags) apply(e *Exporter) {
+	for name, enabled := range f.enabled {
+		e.collectors[name] = *enabled
+	}
+	for name, timeout := range f.timeouts {
+		e.collectorTimeouts[name] = *timeout
+	}
+}
+
+// enabledCollectors builds the enabled collectors of the exporter, by name.
+func (e *Exporter) enabledCollectors() map[string]collector {
+	collectors := make(map[string]collector)
+	for name, f := range collectorFactories {
+		if !e.collectors[name] {
+			continue
+		}
+		if c := f.new(e); c != nil {
+			collectors[name] = c
+		}
+	}
+	return collectors
+}
+
+// collectorTimeout returns the timeout of the named collector.
+func (e *Exporter) collectorTimeout(name string) time.Duration {
+	if timeout, ok := e.collectorTimeouts[name]; ok {
+		return timeout
+	}
+	return defaultCollectorTimeout
+}
+
+// runCollectors runs the collectors concurrently and delivers their metrics
+// along with their outcome. The metrics of a failed collector are dropped,
+// so that a timeout does not export a partial group.
+func (e *Exporter) runCollectors(collectors map[string]collector, stats map[string]string, ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for name, c := range collectors {
+		wg.Add(1)
+		go func(name string, c collector) {
+			defer wg.Done()
+			begin := time.Now()
+			metrics, err := e.runCollector(name, c, stats)
+			duration := time.Since(begin)
+
+			success := 0.0
+			if err != nil {
+				level.Error(e.logger).Log("msg", "Collector failed", "collector", name, "duration_seconds", duration.Seconds(), "err", err)
+			} else {
+				success = 1
+				for _, m := range metrics {
+					ch <- m
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(collectorSuccessDesc, prometheus.GaugeValue, success, name)
+			ch <- prometheus.MustNewConstMetric(collectorDurationDesc, prometheus.GaugeValue, duration.Seconds(), name)
+		}(name, c)
+	}
+	wg.Wait()
+}
+
+// runCollector pipelines the commands of a collector on a connection of the
+// pool and returns its metrics.
+func (e *Exporter) runCollector(name string, c collector, stats map[string]string) (metrics []prometheus.Metric, err error) {
+	conn, err := e.pool.get()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { e.pool.put(conn, err) }()
+
+	if err = conn.SetDeadline(time.Now().Add(e.collectorTimeout(name))); err != nil {
+		return nil, err
+	}
+	if err = conn.send(c.commands()...); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan prometheus.Metric)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.update(conn.reader, stats, ch)
+		close(ch)
+	}()
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics, <-done
+}
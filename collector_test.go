@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/Dev25/mcrouter_exporter/internal/mcroutertest"
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCollectors(t *testing.T) {
+	Convey("Given a remote mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{
+			"stats all":                "STAT version 37.0.0\r\nEND\r\n",
+			"stats servers":            "STAT 10.1.1.1:11211 avg_latency_us:302.991 up:1\r\nEND\r\n",
+			"get __mcrouter__.options": "VALUE __mcrouter__.options 0 13\r\nnum_proxies 4\r\nEND\r\n",
+		})
+		defer l.Close()
+		e := NewExporter(l.Addr(), time.Second, true, log.NewNopLogger())
+		e.options = []string{"num-proxies"}
+
+		Convey("When scraped", func() {
+			values := gatherValues(t, e)
+
+			Convey("Every enabled collector should report its success", func() {
+				So(values[`mcrouter_exporter_collector_success{collector="servers"}`], ShouldEqual, 1)
+				So(values[`mcrouter_exporter_collector_success{collector="config"}`], ShouldEqual, 1)
+				So(values[`mcrouter_option{option="num-proxies"}`], ShouldEqual, 4)
+			})
+		})
+
+		Convey("When a collector times out", func() {
+			l.SetFaults(mcroutertest.Faults{Latency: 50 * time.Millisecond})
+			e.collectorTimeouts["servers"] = 10 * time.Millisecond
+			values := gatherValues(t, e)
+
+			Convey("It should fail without affecting the others", func() {
+				So(values["mcrouter_up{}"], ShouldEqual, 1)
+				So(values[`mcrouter_exporter_collector_success{collector="servers"}`], ShouldEqual, 0)
+				So(values[`mcrouter_exporter_collector_success{collector="config"}`], ShouldEqual, 1)
+				So(values, ShouldNotContainKey, `mcrouter_server_connections{server="10.1.1.1:11211",state="up"}`)
+			})
+		})
+
+		Convey("When a collector is disabled", func() {
+			e.collectors["servers"] = false
+			values := gatherValues(t, e)
+
+			Convey("It should not report anything", func() {
+				So(values, ShouldNotContainKey, `mcrouter_exporter_collector_success{collector="servers"}`)
+				So(values, ShouldNotContainKey, `mcrouter_server_connections{server="10.1.1.1:11211",state="up"}`)
+			})
+		})
+	})
+
+	Convey("Given the collector flags", t, func() {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := registerCollectorFlags(fs)
+		fs.BoolVar(flags.enabled["servers"], "mcrouter.server_metrics", false, "")
+		So(fs.Parse([]string{"-collector.config.timeout=2s", "-mcrouter.server_metrics", "-collector.config=false"}), ShouldBeNil)
+
+		Convey("They should configure the collectors of an exporter", func() {
+			e := NewExporter("localhost:5000", time.Second, false, log.NewNopLogger())
+			flags.apply(e)
+			So(e.collectors, ShouldResemble, map[string]bool{"config": false, "servers": true})
+			So(e.collectorTimeout("config"), ShouldEqual, 2*time.Second)
+			So(e.collectorTimeout("servers"), ShouldEqual, defaultCollectorTimeout)
+		})
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// subcommand is a one-shot mode of the exporter binary, run with
+// `mcrouter_exporter <name> [flags]` instead of starting the HTTP server.
+type subcommand struct {
+	help string
+	run  func(args []string) error
+}
+
+// subcommands lists the available subcommands by name.
+var subcommands = map[string]subcommand{
+	"dashboard": {dashboardHelp, runDashboard},
+	"diff":      {diffHelp, runDiff},
+	"record":    {recordHelp, runRecord},
+	"replay":    {replayHelp, runReplay},
+	"rules":     {rulesHelp, runRules},
+	"scrape":    {scrapeHelp, runScrape},
+	"top":       {topHelp, runTop},
+}
+
+// runSubcommand runs the subcommand named by the first command line
+// argument, if any, and reports whether one was found.
+func runSubcommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return false
+	}
+	err := cmd.run(args[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		// The usage was printed, a success as for -h of the exporter itself
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// newFlagSet returns the flag set of a subcommand, whose usage starts with
+// the subcommand help.
+func newFlagSet(name, help string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mcrouter_exporter %s [flags]\n\n%s\n\n", name, help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// usage prints the usage of the exporter, including subcommands.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: mcrouter_exporter [flags]\n       mcrouter_exporter <command> [flags]\n\nCommands:\n")
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-10s %s\n", name, subcommands[name].help)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// writeMetrics writes the metrics of a gatherer in the Prometheus text
+// format.
+func writeMetrics(w io.Writer, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
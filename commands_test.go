@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSubcommandHelp(t *testing.T) {
+	Convey("Given the subcommands", t, func() {
+		// Keep the printed usages out of the test output
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		So(err, ShouldBeNil)
+		defer devNull.Close()
+		stderr := os.Stderr
+		os.Stderr = devNull
+		defer func() { os.Stderr = stderr }()
+
+		Convey("-h should print the usage without failing", func() {
+			for name, cmd := range subcommands {
+				err := cmd.run([]string{"-h"})
+				So(errors.Is(err, flag.ErrHelp), ShouldBeTrue)
+				So(runSubcommand([]string{name, "-h"}), ShouldBeTrue)
+			}
+		})
+	})
+}
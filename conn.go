@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Delay before dialing mcrouter again after a failed dial, doubled on
+	// each consecutive failure up to maxReconnectBackoff.
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 10 * time.Second
+)
+
+// mcrouterConn is a connection to mcrouter along with the single reader of
+// its replies. Commands can be pipelined: written at once, then their
+// replies read in order.
+type mcrouterConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	lastUsed time.Time
+}
+
+func newMcrouterConn(conn net.Conn) *mcrouterConn {
+	return &mcrouterConn{Conn: conn, reader: bufio.NewReader(conn), lastUsed: time.Now()}
+}
+
+// send writes the commands in a single write, so that mcrouter receives
+// them in as few packets as possible.
+func (c *mcrouterConn) send(commands ...string) error {
+	var b strings.Builder
+	for _, command := range commands {
+		b.WriteString(command)
+		b.WriteString("\r\n")
+	}
+	_, err := c.Write([]byte(b.String()))
+	return err
+}
+
+// reusable reports whether a connection can be used again after an error
+// while reading a reply: mcrouter rejecting a command leaves the connection
+// in sync, other errors leave unread or partial replies behind.
+func reusable(err error) bool {
+	var reply *replyError
+	return err == nil || errors.As(err, &reply)
+}
+
+// connPool keeps idle connections to a mcrouter for reuse across scrapes,
+// sparing the accept path of mcrouter a new client connection every time.
+// Failed dials are retried with an exponential backoff.
+type connPool struct {
+	address string
+	timeout time.Duration
+	// TCP keepalive period of the connections, zero uses the Go default.
+	keepAlive time.Duration
+	// Maximum number of idle connections kept, zero disables reuse.
+	size int
+	// Idle connections unused for longer are checked with the version
+	// command before being handed out.
+	healthCheckAfter time.Duration
+
+	mu       sync.Mutex
+	idle     []*mcrouterConn
+	failures int
+	retryAt  time.Time
+	lastErr  error
+	// Connections returned after close are not kept.
+	closed bool
+}
+
+func newConnPool(address string, timeout time.Duration) *connPool {
+	return &connPool{
+		address:          address,
+		timeout:          timeout,
+		size:             1,
+		healthCheckAfter: 30 * time.Second,
+	}
+}
+
+// get returns an idle connection that passed its health check, or dials a
+// new one.
+func (p *connPool) get() (*mcrouterConn, error) {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return p.dial()
+		}
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if time.Since(c.lastUsed) < p.healthCheckAfter || p.healthCheck(c) == nil {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+// healthCheck checks that an idle connection still answers the version
+// command.
+func (p *connPool) healthCheck(c *mcrouterConn) error {
+	if err := c.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+		return err
+	}
+	if err := c.send("version"); err != nil {
+		return err
+	}
+	_, err := readVersion(c.reader)
+	return err
+}
+
+// dial opens a new connection, using a UNIX socket when the address looks
+// like a path, unless a previous dial failed too recently.
+func (p *connPool) dial() (*mcrouterConn, error) {
+	p.mu.Lock()
+	if wait := time.Until(p.retryAt); wait > 0 {
+		err := fmt.Errorf("reconnecting to %s in %s: %w", p.address, wait.Round(time.Millisecond), p.lastErr)
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.mu.Unlock()
+
+	network := "tcp"
+	if strings.Contains(p.address, "/") {
+		network = "unix"
+	}
+	dialer := net.Dialer{Timeout: p.timeout, KeepAlive: p.keepAlive}
+	conn, err := dialer.Dial(network, p.address)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		backoff := maxReconnectBackoff
+		if p.failures < 20 {
+			backoff = minReconnectBackoff << p.failures
+		}
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+		p.failures++
+		p.retryAt = time.Now().Add(backoff)
+		p.lastErr = err
+		return nil, err
+	}
+	p.failures = 0
+	p.retryAt = time.Time{}
+	return newMcrouterConn(conn), nil
+}
+
+// put hands a connection back after use, along with the error met while
+// using it if any. Connections left out of sync by the error, or exceeding
+// the pool size, are closed.
+func (p *connPool) put(c *mcrouterConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !reusable(err) || p.closed || len(p.idle) >= p.size {
+		c.Close()
+		return
+	}
+	c.lastUsed = time.Now()
+	p.idle = append(p.idle, c)
+}
+
+// close closes the idle connections, and the connections in use as they
+// are returned.
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.Close()
+	}
+	p.idle = nil
+}
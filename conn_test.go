@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dev25/mcrouter_exporter/internal/mcroutertest"
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConnectionPool(t *testing.T) {
+	Convey("Given a remote mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{
+			"stats all":     "STAT version 37.0.0\r\nEND\r\n",
+			"stats servers": "STAT 10.1.1.1:11211 avg_latency_us:302.991 up:1\r\nEND\r\n",
+			"version":       "VERSION 37.0.0\r\n",
+		})
+		defer l.Close()
+		e := NewExporter(l.Addr(), time.Second, true, log.NewNopLogger())
+
+		Convey("Consecutive scrapes should reuse the same connection", func() {
+			gatherValues(t, e)
+			So(e.pool.idle, ShouldHaveLength, 1)
+			c := e.pool.idle[0]
+
+			values := gatherValues(t, e)
+			So(values["mcrouter_up{}"], ShouldEqual, 1)
+			So(values[`mcrouter_server_connections{server="10.1.1.1:11211",state="up"}`], ShouldEqual, 1)
+			So(e.pool.idle, ShouldResemble, []*mcrouterConn{c})
+		})
+
+		Convey("Idle connections should be health checked before reuse", func() {
+			gatherValues(t, e)
+			c := e.pool.idle[0]
+			e.pool.healthCheckAfter = 0
+			l.SetFaults(mcroutertest.Faults{DisconnectAfter: 3})
+
+			values := gatherValues(t, e)
+			So(values["mcrouter_up{}"], ShouldEqual, 1)
+			So(e.pool.idle, ShouldNotContain, c)
+		})
+
+		Convey("A failing stats group should report mcrouter as up only once", func() {
+			l.SetReply("stats servers", "ERROR\r\n")
+			values := gatherValues(t, e)
+			So(values["mcrouter_up{}"], ShouldEqual, 1)
+			So(values[`mcrouter_exporter_collector_success{collector="servers"}`], ShouldEqual, 0)
+
+			Convey("And keep the connection, which is still in sync", func() {
+				So(e.pool.idle, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("A connection left out of sync should be closed", func() {
+			l.SetReply("stats servers", "garbage\r\nEND\r\n")
+			values := gatherValues(t, e)
+			So(values["mcrouter_up{}"], ShouldEqual, 1)
+			So(values[`mcrouter_exporter_collector_success{collector="servers"}`], ShouldEqual, 0)
+			So(e.pool.idle, ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given an unreachable mcrouter", t, func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		l.Close()
+		p := newConnPool(l.Addr().String(), time.Second)
+
+		Convey("Dialing again should wait for the backoff", func() {
+			_, err := p.get()
+			So(err, ShouldNotBeNil)
+			_, err = p.get()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldStartWith, "reconnecting to "+l.Addr().String())
+
+			Convey("Which doubles on each failure", func() {
+				p.retryAt = time.Time{}
+				p.get()
+				So(time.Until(p.retryAt), ShouldBeBetween, minReconnectBackoff, 2*minReconnectBackoff+time.Millisecond)
+			})
+		})
+	})
+
+	Convey("Pipelined commands should be written at once", t, func() {
+		server, client := net.Pipe()
+		received := make(chan string, 1)
+		go func() {
+			buf := make([]byte, 1024)
+			n, _ := server.Read(buf)
+			received <- string(buf[:n])
+			server.Close()
+		}()
+		So(newMcrouterConn(client).send("stats all", "stats servers"), ShouldBeNil)
+		So(<-received, ShouldEqual, strings.Join([]string{"stats all", "stats servers", ""}, "\r\n"))
+	})
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const dashboardHelp = "Print a Grafana dashboard for the exporter's metrics."
+
+// dashboardExcluded are the metrics of the catalog left out of the dashboard
+// on purpose, along with the reason.
+var dashboardExcluded = map[string]string{
+	namespace + "_commandargs":          "info metric, the command line does not plot",
+	namespace + "_version":              "info metric, the version does not plot",
+	namespace + "_option_info":          "info metric, numeric options are plotted from mcrouter_option",
+	namespace + "_start_time_seconds":   "plotted as mcrouter_uptime_seconds",
+	namespace + "_command_out_count":    "described but not collected",
+	namespace + "_command_out_failover": "described but not collected",
+	namespace + "_command_out_shadow":   "described but not collected",
+	namespace + "_result_failover":      "described but not collected",
+	namespace + "_result_shadow":        "described but not collected",
+}
+
+// Grafana dashboard model, limited to what the generated dashboard uses.
+type grafanaDashboard struct {
+	UID           string            `json:"uid"`
+	Title         string            `json:"title"`
+	Tags          []string          `json:"tags"`
+	Editable      bool              `json:"editable"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          map[string]string `json:"time"`
+	Templating    struct {
+		List []grafanaVariable `json:"list"`
+	} `json:"templating"`
+	Panels []grafanaPanel `json:"panels"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Query      string             `json:"query"`
+	Datasource *grafanaDatasource `json:"datasource,omitempty"`
+	Refresh    int                `json:"refresh,omitempty"`
+	IncludeAll bool               `json:"includeAll,omitempty"`
+	Multi      bool               `json:"multi,omitempty"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaPanel struct {
+	ID          int                `json:"id"`
+	Type        string             `json:"type"`
+	Title       string             `json:"title"`
+	Description string             `json:"description,omitempty"`
+	GridPos     grafanaGridPos     `json:"gridPos"`
+	Datasource  *grafanaDatasource `json:"datasource,omitempty"`
+	Targets     []grafanaTarget    `json:"targets,omitempty"`
+	FieldConfig *grafanaFieldConf  `json:"fieldConfig,omitempty"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+type grafanaFieldConf struct {
+	Defaults struct {
+		Unit string `json:"unit"`
+	} `json:"defaults"`
+	Overrides []struct{} `json:"overrides"`
+}
+
+// dashboardRow is a section of the dashboard.
+type dashboardRow struct {
+	title  string
+	panels []dashboardPanel
+}
+
+type dashboardPanel struct {
+	title   string
+	unit    string
+	queries []grafanaTarget
+	// Help of the first metric queried, used as the panel description.
+	help string
+}
+
+// dashboardBuilder builds the queries of the panels from the metric
+// catalog, selecting the instances picked in the dashboard.
+type dashboardBuilder struct {
+	queryBuilder
+	// Label identifying a mcrouter, instance or target in fleet mode.
+	instanceLabel string
+}
+
+// sel returns the selector of a metric for the picked instances.
+func (b *dashboardBuilder) sel(name string, matchers ...string) string {
+	matchers = append([]string{fmt.Sprintf(`%s=~"$instance"`, b.instanceLabel)}, matchers...)
+	return b.metric(name) + "{" + strings.Join(matchers, ", ") + "}"
+}
+
+// rate returns the per-second rate of a counter for the picked instances.
+func (b *dashboardBuilder) rate(name string, matchers ...string) string {
+	return "rate(" + b.sel(name, matchers...) + "[$__rate_interval])"
+}
+
+// panel returns a panel plotting the queries, which alternate expressions
+// and legends.
+func (b *dashboardBuilder) panel(title, unit string, queries ...string) dashboardPanel {
+	p := dashboardPanel{title: title, unit: unit}
+	for i := 0; i+1 < len(queries); i += 2 {
+		p.queries = append(p.queries, grafanaTarget{
+			RefID:        string(rune('A' + i/2)),
+			Expr:         queries[i],
+			LegendFormat: strings.ReplaceAll(queries[i+1], "{{instance}}", "{{"+b.instanceLabel+"}}"),
+		})
+	}
+	for _, name := range metricNamePattern.FindAllString(queries[0], 1) {
+		p.help = b.catalog[name].help
+	}
+	return p
+}
+
+// dashboardRows lays out the metrics of the catalog by section, with the
+// per-server metrics when serverMetrics is set.
+func dashboardRows(b *dashboardBuilder, serverMetrics bool) []dashboardRow {
+	ns := namespace + "_"
+	rows := []dashboardRow{
+		{"Overview", []dashboardPanel{
+			b.panel("Up", "short", b.sel(ns+"up"), "{{instance}}"),
+			b.panel("Uptime", "s", b.sel(ns+"uptime_seconds"), "{{instance}}"),
+			b.panel("Restarts", "short",
+				"increase("+b.sel(ns+"restarts_total")+"[$__rate_interval])", "{{instance}}"),
+			b.panel("Last restart", "dateTimeAsIso",
+				b.sel(ns+"last_restart_timestamp_seconds")+" * 1000", "{{instance}} {{reason}}"),
+			b.panel("Request duration", "µs", b.sel(ns+"duration_us"), "{{instance}}"),
+			b.panel("Sampled request duration", "s",
+				"histogram_quantile(0.5, "+b.rate(ns+"duration_sample_seconds")+")", "{{instance}} p50",
+				"histogram_quantile(0.99, "+b.rate(ns+"duration_sample_seconds")+")", "{{instance}} p99"),
+			b.panel("CPU", "short", b.rate(ns+"cpu_seconds_total"), "{{instance}}"),
+			b.panel("Memory", "bytes",
+				b.sel(ns+"resident_memory_bytes"), "{{instance}} resident",
+				b.sel(ns+"virtual_memory_bytes"), "{{instance}} virtual"),
+			b.panel("Exporter collectors", "short",
+				"min by (collector) ("+b.sel(ns+"exporter_collector_success")+")", "{{collector}}"),
+			b.panel("Exporter collector duration", "s",
+				"max by (collector) ("+b.sel(ns+"exporter_collector_duration_seconds")+")", "{{collector}}"),
+		}},
+		{"Commands", []dashboardPanel{
+			b.panel("Received requests (average)", "reqps", "sum by (cmd) ("+b.sel(ns+"commands")+")", "{{cmd}}"),
+			b.panel("Received requests", "reqps", "sum by (cmd) ("+b.rate(ns+"command_count")+")", "{{cmd}}"),
+			b.panel("Sent requests (average)", "reqps",
+				"sum by (cmd) ("+b.sel(ns+"command_out")+")", "{{cmd}} normal",
+				"sum by (cmd) ("+b.sel(ns+"command_out_all")+")", "{{cmd}} all"),
+			b.panel("DevNullRoute requests", "reqps", b.rate(ns+"dev_null_requests"), "{{instance}}"),
+		}},
+		{"Results", []dashboardPanel{
+			b.panel("Requests (average)", "reqps", "sum by (type) ("+b.sel(ns+"request")+")", "{{type}}"),
+			b.panel("Requests", "reqps", "sum by (type) ("+b.rate(ns+"request_count")+")", "{{type}}"),
+			b.panel("Error replies (average)", "reqps",
+				"sum by (reply) ("+b.sel(ns+"results")+")", "{{reply}} normal",
+				"sum by (reply) ("+b.sel(ns+"result_all")+")", "{{reply}} all"),
+			b.panel("Error replies", "reqps",
+				"sum by (reply) ("+b.rate(ns+"result_count")+")", "{{reply}} normal",
+				"sum by (reply) ("+b.rate(ns+"result_all_count")+")", "{{reply}} all"),
+		}},
+		{"Connections", []dashboardPanel{
+			b.panel("Memcached servers", "short", "sum by (state) ("+b.sel(ns+"servers")+")", "{{state}}"),
+			b.panel("Clients", "short",
+				b.sel(ns+"clients"), "{{instance}} clients",
+				b.sel(ns+"num_client_connections"), "{{instance}} connections"),
+			b.panel("Queued requests", "short",
+				b.sel(ns+"proxy_reqs_processing"), "{{instance}} processing",
+				b.sel(ns+"proxy_reqs_waiting"), "{{instance}} waiting"),
+		}},
+		{"Fibers", []dashboardPanel{
+			b.panel("Fibers", "short",
+				b.sel(ns+"fibers_allocated"), "{{instance}} allocated",
+				b.sel(ns+"fibers_pool_size"), "{{instance}} pool"),
+		}},
+		{"Config", []dashboardPanel{
+			b.panel("Config age", "s", b.sel(ns+"config_age_seconds"), "{{instance}}"),
+			b.panel("Config failing", "s", b.sel(ns+"config_failing_seconds"), "{{instance}}"),
+			b.panel("Config reloads", "short",
+				"sum by (result) (increase("+b.sel(ns+"config_reloads_total")+"[$__rate_interval]))", "{{result}}"),
+			b.panel("Config failures", "short",
+				"increase("+b.sel(ns+"config_failures")+"[$__rate_interval])", "{{instance}}"),
+			b.panel("Time since last config attempt", "s",
+				"time() - "+b.sel(ns+"config_last_attempt"), "{{instance}} attempt",
+				"time() - "+b.sel(ns+"config_last_success"), "{{instance}} success"),
+			b.panel("Startup options", "short", b.sel(ns+"option"), "{{instance}} {{option}}"),
+			b.panel("Config drift", "short", b.sel(ns+"config_drift"), "{{target}} {{aspect}}"),
+		}},
+		{"Asynclog", []dashboardPanel{
+			b.panel("Spooled deletes", "reqps", b.rate(ns+"asynclog_requests"), "{{instance}}"),
+			b.panel("Spooling", "reqps",
+				b.sel(ns+"asynclog_requests_rate"), "{{instance}} attempted",
+				b.sel(ns+"asynclog_spool_success_rate"), "{{instance}} spooled"),
+		}},
+	}
+	if !serverMetrics {
+		return rows
+	}
+
+	var replies []string
+	for _, reply := range []string{"found", "not_found", "stored", "not_stored", "deleted", "touched", "exists"} {
+		replies = append(replies, "sum("+b.rate(ns+"server_memcached_"+reply+"_count")+")", reply)
+	}
+	var errors []string
+	for _, reply := range []string{"remote_error", "timeout", "connect_timeout"} {
+		errors = append(errors, "sum by (server) ("+b.rate(ns+"server_memcached_"+reply+"_count")+")", "{{server}} "+reply)
+	}
+	return append(rows, dashboardRow{"Servers", []dashboardPanel{
+		b.panel("Latency", "µs", "max by (server) ("+b.sel(ns+"server_duration_us")+")", "{{server}}"),
+		b.panel("Sampled latency p99", "s",
+			"histogram_quantile(0.99, sum by (server) ("+b.rate(ns+"server_duration_sample_seconds")+"))", "{{server}}"),
+		b.panel("Replies", "reqps", replies...),
+		b.panel("Errors", "reqps", errors...),
+		b.panel("Queued requests", "short",
+			"sum by (server) ("+b.sel(ns+"server_proxy_reqs_processing")+")", "{{server}} processing",
+			"sum by (server) ("+b.sel(ns+"server_proxy_reqs_waiting")+")", "{{server}} waiting"),
+		b.panel("Retransmissions", "short",
+			"max by (server) ("+b.sel(ns+"server_proxy_reqs_retrans_ratio")+")", "{{server}}",
+			"max by (server) ("+b.sel(ns+"server_retrans_ratio", `stat="max"`)+")", "{{server}} max"),
+		b.panel("Connections", "short", "sum by (state) ("+b.sel(ns+"server_connections")+")", "{{state}}"),
+		b.panel("TKO", "short",
+			"sum by (server) ("+b.sel(ns+"server_memcached_soft_tko")+")", "{{server}} soft",
+			"sum by (server) ("+b.sel(ns+"server_memcached_hard_tko")+")", "{{server}} hard"),
+		b.panel("TKO transitions", "short",
+			"sum by (server, kind) (increase("+b.sel(ns+"server_tko_transitions_total")+"[$__rate_interval]))", "{{server}} {{kind}}"),
+		b.panel("Time in TKO", "percentunit",
+			"max by (server, kind) ("+b.rate(ns+"server_tko_seconds_total")+")", "{{server}} {{kind}}"),
+	}})
+}
+
+// generateDashboard lays out the panels of the rows on a Grafana dashboard,
+// two panels wide. It fails when a panel queries a metric the exporter does
+// not export.
+func generateDashboard(catalog map[string]catalogMetric, title, uid, instanceLabel string, serverMetrics bool) (grafanaDashboard, error) {
+	b := &dashboardBuilder{queryBuilder: queryBuilder{catalog: catalog}, instanceLabel: instanceLabel}
+	rows := dashboardRows(b, serverMetrics)
+	if err := b.err(); err != nil {
+		return grafanaDashboard{}, fmt.Errorf("dashboard panels %w", err)
+	}
+
+	datasource := &grafanaDatasource{Type: "prometheus", UID: "$datasource"}
+	d := grafanaDashboard{
+		UID:           uid,
+		Title:         title,
+		Tags:          []string{"mcrouter"},
+		Editable:      true,
+		SchemaVersion: 36,
+		Refresh:       "30s",
+		Time:          map[string]string{"from": "now-1h", "to": "now"},
+	}
+	d.Templating.List = []grafanaVariable{
+		{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		{
+			Name: "instance", Label: "Instance", Type: "query", Datasource: datasource, Refresh: 2, IncludeAll: true, Multi: true,
+			Query: fmt.Sprintf("label_values(%s_up, %s)", namespace, instanceLabel),
+		},
+	}
+
+	id, y := 1, 0
+	for _, row := range rows {
+		d.Panels = append(d.Panels, grafanaPanel{ID: id, Type: "row", Title: row.title, GridPos: grafanaGridPos{H: 1, W: 24, Y: y}})
+		id, y = id+1, y+1
+		for i, p := range row.panels {
+			panel := grafanaPanel{
+				ID:          id,
+				Type:        "timeseries",
+				Title:       p.title,
+				Description: p.help,
+				GridPos:     grafanaGridPos{H: 8, W: 12, X: 12 * (i % 2), Y: y + 8*(i/2)},
+				Datasource:  datasource,
+				Targets:     p.queries,
+				FieldConfig: &grafanaFieldConf{Overrides: []struct{}{}},
+			}
+			panel.FieldConfig.Defaults.Unit = p.unit
+			d.Panels = append(d.Panels, panel)
+			id++
+		}
+		y += 8 * ((len(row.panels) + 1) / 2)
+	}
+	return d, nil
+}
+
+// runDashboard prints the dashboard generated from the metric catalog as
+// Grafana JSON.
+func runDashboard(args []string) error {
+	fs := newFlagSet("dashboard", dashboardHelp)
+	var (
+		out           = fs.String("out", "-", "Dashboard file to write, - for stdout.")
+		title         = fs.String("title", "Mcrouter", "Title of the dashboard.")
+		uid           = fs.String("uid", "mcrouter", "UID of the dashboard.")
+		instanceLabel = fs.String("instance-label", "instance", "Label identifying a mcrouter, e.g. target in fleet mode.")
+		serverMetrics = fs.Bool("server-metrics", false, "Add the panels of the per-server metrics, for exporters running with -collector.servers.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	catalog, err := metricCatalog()
+	if err != nil {
+		return err
+	}
+	d, err := generateDashboard(catalog, *title, *uid, *instanceLabel, *serverMetrics)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(d)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Metrics queried by the panels of a dashboard
+func dashboardMetrics(d grafanaDashboard) map[string]bool {
+	metrics := make(map[string]bool)
+	for _, p := range d.Panels {
+		for _, target := range p.Targets {
+			for _, name := range metricNamePattern.FindAllString(target.Expr, -1) {
+				metrics[name] = true
+			}
+		}
+	}
+	return metrics
+}
+
+func TestDashboard(t *testing.T) {
+	Convey("Given the metric catalog", t, func() {
+		catalog, err := metricCatalog()
+		So(err, ShouldBeNil)
+
+		Convey("The dashboard with per-server panels should cover every metric of the catalog", func() {
+			d, err := generateDashboard(catalog, "Mcrouter", "mcrouter", "instance", true)
+			So(err, ShouldBeNil)
+			queried := dashboardMetrics(d)
+			for name := range catalog {
+				if _, excluded := dashboardExcluded[name]; !excluded {
+					So(queried, ShouldContainKey, name)
+				}
+			}
+			for name := range queried {
+				So(catalog, ShouldContainKey, name)
+				So(dashboardExcluded, ShouldNotContainKey, name)
+			}
+		})
+
+		Convey("Excluded metrics should still be in the catalog", func() {
+			for name := range dashboardExcluded {
+				So(catalog, ShouldContainKey, name)
+			}
+		})
+
+		Convey("The dashboard without per-server panels should not query them", func() {
+			d, err := generateDashboard(catalog, "Mcrouter", "mcrouter", "instance", false)
+			So(err, ShouldBeNil)
+			for name := range dashboardMetrics(d) {
+				So(name, ShouldNotStartWith, namespace+"_server_")
+			}
+		})
+
+		Convey("Panels querying unknown metrics should be rejected", func() {
+			delete(catalog, namespace+"_fibers_allocated")
+			_, err := generateDashboard(catalog, "Mcrouter", "mcrouter", "instance", false)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "mcrouter_fibers_allocated")
+		})
+	})
+
+	Convey("When generating a dashboard for a fleet", t, func() {
+		out := filepath.Join(t.TempDir(), "mcrouter.json")
+		So(runDashboard([]string{"-out", out, "-instance-label", "target", "-server-metrics"}), ShouldBeNil)
+		content, err := os.ReadFile(out)
+		So(err, ShouldBeNil)
+		var d grafanaDashboard
+		So(json.Unmarshal(content, &d), ShouldBeNil)
+
+		Convey("Panels should select and label the picked targets", func() {
+			So(d.Templating.List[1].Query, ShouldEqual, "label_values(mcrouter_up, target)")
+			for _, p := range d.Panels {
+				for _, target := range p.Targets {
+					So(target.Expr, ShouldContainSubstring, `target=~"$instance"`)
+					So(target.LegendFormat, ShouldNotContainSubstring, "{{instance}}")
+				}
+			}
+		})
+
+		Convey("Panels should have unique IDs and not overlap", func() {
+			ids := make(map[int]bool)
+			cells := make(map[[2]int]string)
+			for _, p := range d.Panels {
+				So(ids, ShouldNotContainKey, p.ID)
+				ids[p.ID] = true
+				for x := p.GridPos.X; x < p.GridPos.X+p.GridPos.W; x++ {
+					for y := p.GridPos.Y; y < p.GridPos.Y+p.GridPos.H; y++ {
+						So(cells, ShouldNotContainKey, [2]int{x, y})
+						cells[[2]int{x, y}] = p.Title
+					}
+				}
+			}
+			So(strings.Count(string(content), `"type": "row"`), ShouldEqual, 8)
+		})
+	})
+}
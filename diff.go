@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const diffHelp = "Compare two stats snapshots, each a JSON file saved by scrape or a live target: diff <before> <after>, or diff <target> to scrape it twice."
+
+// statDelta is the change of a stat between two snapshots. The delta and
+// rate are only set for numeric stats.
+type statDelta struct {
+	name    string
+	before  string
+	after   string
+	numeric bool
+	delta   float64
+	// Per second, 0 when the snapshots were taken at the same time.
+	rate float64
+}
+
+// snapshotDiff lists the stats that changed between two snapshots, by
+// name, along with the destinations that appeared or disappeared.
+type snapshotDiff struct {
+	elapsed time.Duration
+	stats   []statDelta
+	// Changed stats of the destinations in both snapshots, by server.
+	servers map[string][]statDelta
+	added   []string
+	removed []string
+}
+
+// diffSnapshots compares the stats of two snapshots.
+func diffSnapshots(before, after *snapshot) *snapshotDiff {
+	d := &snapshotDiff{
+		elapsed: after.Time.Sub(before.Time),
+		servers: make(map[string][]statDelta),
+	}
+	d.stats = diffStats(before.Stats, after.Stats, d.elapsed)
+	for server, stats := range after.Servers {
+		previous, ok := before.Servers[server]
+		if !ok {
+			d.added = append(d.added, server)
+			continue
+		}
+		if deltas := diffStats(previous, stats, d.elapsed); len(deltas) > 0 {
+			d.servers[server] = deltas
+		}
+	}
+	for server := range before.Servers {
+		if _, ok := after.Servers[server]; !ok {
+			d.removed = append(d.removed, server)
+		}
+	}
+	sort.Strings(d.added)
+	sort.Strings(d.removed)
+	return d
+}
+
+// diffStats returns the stats whose value changed, sorted by name. Stats
+// missing from one side are compared to an empty value.
+func diffStats(before, after map[string]string, elapsed time.Duration) []statDelta {
+	var deltas []statDelta
+	visit := func(name string) {
+		b, a := before[name], after[name]
+		if a == b {
+			return
+		}
+		delta := statDelta{name: name, before: b, after: a}
+		bv, bErr := parseDiffValue(b)
+		av, aErr := parseDiffValue(a)
+		if bErr == nil && aErr == nil {
+			delta.numeric = true
+			delta.delta = av - bv
+			if elapsed > 0 {
+				delta.rate = delta.delta / elapsed.Seconds()
+			}
+		}
+		deltas = append(deltas, delta)
+	}
+	for name := range after {
+		visit(name)
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			visit(name)
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].name < deltas[j].name })
+	return deltas
+}
+
+// parseDiffValue parses a numeric stat, a missing stat counting as 0.
+func parseDiffValue(v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+// writeDiff prints the changed stats, then the new and removed destinations
+// and the changed stats of the others.
+func writeDiff(w io.Writer, before, after *snapshot, d *snapshotDiff) error {
+	fmt.Fprintf(w, "Before: %s at %s\n", before.Target, before.Time.Format(time.RFC3339))
+	fmt.Fprintf(w, "After:  %s at %s (%s later)\n", after.Target, after.Time.Format(time.RFC3339), d.elapsed.Round(time.Millisecond))
+	if before.Stats["version"] != after.Stats["version"] {
+		fmt.Fprintf(w, "Version: %s -> %s\n", before.Stats["version"], after.Stats["version"])
+	}
+
+	fmt.Fprintln(w)
+	if len(d.stats) == 0 {
+		fmt.Fprintln(w, "No stats changed.")
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "STAT\tBEFORE\tAFTER\tDELTA\tRATE/s")
+		writeDeltas(tw, "", d.stats)
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(d.added)+len(d.removed) > 0 {
+		fmt.Fprintln(w)
+		for _, server := range d.added {
+			fmt.Fprintf(w, "+ %s (new)\n", server)
+		}
+		for _, server := range d.removed {
+			fmt.Fprintf(w, "- %s (removed)\n", server)
+		}
+	}
+
+	if len(d.servers) > 0 {
+		servers := make([]string, 0, len(d.servers))
+		for server := range d.servers {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+
+		fmt.Fprintln(w)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "SERVER\tSTAT\tBEFORE\tAFTER\tDELTA\tRATE/s")
+		for _, server := range servers {
+			writeDeltas(tw, server+"\t", d.servers[server])
+		}
+		return tw.Flush()
+	}
+	return nil
+}
+
+// writeDeltas prints a line per changed stat, starting with prefix.
+func writeDeltas(w io.Writer, prefix string, deltas []statDelta) {
+	for _, delta := range deltas {
+		change, rate := "-", "-"
+		if delta.numeric {
+			change = strconv.FormatFloat(delta.delta, 'f', -1, 64)
+			if delta.delta > 0 {
+				change = "+" + change
+			}
+			if delta.rate != 0 {
+				rate = strconv.FormatFloat(delta.rate, 'f', 3, 64)
+			}
+		}
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\t%s\n", prefix, delta.name, orDash(delta.before), orDash(delta.after), change, rate)
+	}
+}
+
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// loadSnapshot reads the snapshot saved at source, or scrapes source when
+// it is not a regular file, such as the UNIX socket of mcrouter.
+func loadSnapshot(source string, timeout time.Duration) (*snapshot, error) {
+	if info, err := os.Stat(source); err == nil && info.Mode().IsRegular() {
+		return readSnapshot(source)
+	}
+	s, err := takeSnapshot(source, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither a snapshot file nor a reachable target: %w", source, err)
+	}
+	return s, nil
+}
+
+// runDiff compares two snapshots of mcrouter.
+func runDiff(args []string) error {
+	fs := newFlagSet("diff", diffHelp)
+	var (
+		interval = fs.Duration("interval", 10*time.Second, "Time between the two scrapes of a single live target.")
+		timeout  = fs.Duration("timeout", 5*time.Second, "Timeout of a scrape of a live target.")
+		out      = fs.String("out", "-", "File to write the comparison to, - for stdout.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var before, after *snapshot
+	var err error
+	switch fs.NArg() {
+	case 1:
+		if before, err = takeSnapshot(fs.Arg(0), *timeout); err != nil {
+			return err
+		}
+		time.Sleep(*interval)
+		if after, err = takeSnapshot(fs.Arg(0), *timeout); err != nil {
+			return err
+		}
+	case 2:
+		if before, err = loadSnapshot(fs.Arg(0), *timeout); err != nil {
+			return err
+		}
+		if after, err = loadSnapshot(fs.Arg(1), *timeout); err != nil {
+			return err
+		}
+	default:
+		fs.Usage()
+		return fmt.Errorf("expected one live target or two snapshots, got %d arguments", fs.NArg())
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return writeDiff(w, before, after, diffSnapshots(before, after))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiff(t *testing.T) {
+	Convey("Given two snapshots taken 10 seconds apart", t, func() {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		before := &snapshot{
+			Target: "a:5000",
+			Time:   start,
+			Stats:  map[string]string{"version": "37.0.0", "cmd_get_count": "100", "config_failures": "1", "uptime": "600"},
+			Servers: map[string]map[string]string{
+				"s1": {"found": "10", "soft_tko": "0"},
+				"s2": {"found": "5"},
+			},
+		}
+		after := &snapshot{
+			Target: "a:5000",
+			Time:   start.Add(10 * time.Second),
+			Stats:  map[string]string{"version": "38.0.0", "cmd_get_count": "150", "config_failures": "1", "uptime": "610", "cmd_set_count": "20"},
+			Servers: map[string]map[string]string{
+				"s1": {"found": "30", "soft_tko": "1"},
+				"s3": {"found": "1"},
+			},
+		}
+
+		Convey("Only the changed stats should be reported, with deltas and rates", func() {
+			d := diffSnapshots(before, after)
+			So(d.elapsed, ShouldEqual, 10*time.Second)
+			So(d.stats, ShouldResemble, []statDelta{
+				{name: "cmd_get_count", before: "100", after: "150", numeric: true, delta: 50, rate: 5},
+				{name: "cmd_set_count", after: "20", numeric: true, delta: 20, rate: 2},
+				{name: "uptime", before: "600", after: "610", numeric: true, delta: 10, rate: 1},
+				{name: "version", before: "37.0.0", after: "38.0.0"},
+			})
+			So(d.servers["s1"], ShouldResemble, []statDelta{
+				{name: "found", before: "10", after: "30", numeric: true, delta: 20, rate: 2},
+				{name: "soft_tko", before: "0", after: "1", numeric: true, delta: 1, rate: 0.1},
+			})
+			So(d.added, ShouldResemble, []string{"s3"})
+			So(d.removed, ShouldResemble, []string{"s2"})
+		})
+
+		Convey("Diffing saved snapshots should highlight new and removed destinations", func() {
+			dir := t.TempDir()
+			save := func(name string, s *snapshot) string {
+				content, err := json.Marshal(s)
+				So(err, ShouldBeNil)
+				path := filepath.Join(dir, name)
+				So(os.WriteFile(path, content, 0o644), ShouldBeNil)
+				return path
+			}
+			out := filepath.Join(dir, "diff")
+			So(runDiff([]string{"-out", out, save("before.json", before), save("after.json", after)}), ShouldBeNil)
+			content, err := os.ReadFile(out)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, "Version: 37.0.0 -> 38.0.0\n")
+			So(string(content), ShouldContainSubstring, "+ s3 (new)\n- s2 (removed)\n")
+			So(string(content), ShouldContainSubstring, "cmd_get_count  100     150     +50    5.000")
+			So(string(content), ShouldContainSubstring, "s1      soft_tko  0       1      +1     0.100")
+		})
+	})
+
+	Convey("Given a fake mcrouter 37", t, func() {
+		s := startFakeMcrouter(t, "127.0.0.1:0", "mcrouter-37.script")
+		defer s.Close()
+		out := filepath.Join(t.TempDir(), "diff")
+
+		Convey("Scraping it twice should report no change", func() {
+			So(runDiff([]string{"-interval", "0", "-out", out, s.Addr()}), ShouldBeNil)
+			content, err := os.ReadFile(out)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, "No stats changed.")
+		})
+
+		Convey("A target that cannot be reached should be reported", func() {
+			err := runDiff([]string{"-timeout", "100ms", s.Addr(), "127.0.0.1:1"})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "neither a snapshot file nor a reachable target")
+		})
+
+		Convey("Other argument counts should be rejected", func() {
+			So(runDiff([]string{"-out", out}), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a fake mcrouter 37 on a UNIX socket", t, func() {
+		s := startFakeMcrouter(t, filepath.Join(t.TempDir(), "mcrouter.sock"), "mcrouter-37.script")
+		defer s.Close()
+		out := filepath.Join(t.TempDir(), "diff")
+
+		Convey("The socket should be scraped rather than read as a snapshot", func() {
+			So(runDiff([]string{"-out", out, s.Addr(), s.Addr()}), ShouldBeNil)
+			content, err := os.ReadFile(out)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, "No stats changed.")
+		})
+	})
+}
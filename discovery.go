@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// discoverer finds the mcrouter targets of a fleet.
+type discoverer interface {
+	discover(ctx context.Context) ([]target, error)
+}
+
+// runDiscovery updates the targets of the fleet found by the named source
+// every interval until the context is done. The targets are kept as they
+// are when discovery fails.
+func runDiscovery(ctx context.Context, source string, d discoverer, f *fleet, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if targets, err := d.discover(ctx); err != nil {
+			level.Error(logger).Log("msg", "Failed to discover mcrouter targets", "source", source, "err", err)
+		} else {
+			level.Debug(logger).Log("msg", "Discovered mcrouter targets", "source", source, "count", len(targets))
+			f.updateSource(source, targets)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileDiscovery(t *testing.T) {
+	Convey("Given file_sd files", t, func() {
+		dir := t.TempDir()
+		jsonFile := filepath.Join(dir, "mcrouter.json")
+		yamlFile := filepath.Join(dir, "mcrouter.yml")
+		os.WriteFile(jsonFile, []byte(`[{"targets": ["10.0.0.1:5000", "10.0.0.2:5000"], "labels": {"cluster": "east"}}]`), 0o644)
+		os.WriteFile(yamlFile, []byte("- targets: ['10.0.1.1:5000']\n  labels:\n    cluster: west\n"), 0o644)
+
+		d, err := newFileDiscovery([]string{filepath.Join(dir, "*.json"), yamlFile})
+		So(err, ShouldBeNil)
+		targets, err := d.discover(context.Background())
+		So(err, ShouldBeNil)
+
+		Convey("It should read the targets and labels of JSON and YAML files", func() {
+			So(targets, ShouldResemble, []target{
+				{address: "10.0.0.1:5000", labels: map[string]string{"cluster": "east"}},
+				{address: "10.0.0.2:5000", labels: map[string]string{"cluster": "east"}},
+				{address: "10.0.1.1:5000", labels: map[string]string{"cluster": "west"}},
+			})
+		})
+
+		Convey("It should read a file again when it changes", func() {
+			os.WriteFile(yamlFile, []byte("- targets: ['10.0.1.2:5000']\n"), 0o644)
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(yamlFile, later, later)
+			targets, err := d.discover(context.Background())
+			So(err, ShouldBeNil)
+			So(targets, ShouldHaveLength, 3)
+			So(targets[2], ShouldResemble, target{address: "10.0.1.2:5000"})
+		})
+
+		Convey("It should pick up new files matching a pattern", func() {
+			os.WriteFile(filepath.Join(dir, "more.json"), []byte(`[{"targets": ["10.0.2.1:5000"]}]`), 0o644)
+			targets, err := d.discover(context.Background())
+			So(err, ShouldBeNil)
+			So(targets, ShouldHaveLength, 4)
+		})
+
+		Convey("It should reject reserved label names", func() {
+			os.WriteFile(jsonFile, []byte(`[{"targets": ["10.0.0.1:5000"], "labels": {"target": "x"}}]`), 0o644)
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(jsonFile, later, later)
+			_, err := d.discover(context.Background())
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `invalid label name "target"`)
+		})
+	})
+
+	Convey("Given a file with an unknown extension", t, func() {
+		path := filepath.Join(t.TempDir(), "targets.txt")
+		os.WriteFile(path, []byte("10.0.0.1:5000"), 0o644)
+		d, _ := newFileDiscovery([]string{path})
+
+		Convey("Discovery should fail", func() {
+			_, err := d.discover(context.Background())
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	Convey("Given SRV records", t, func() {
+		d, err := newDNSDiscovery([]string{"_mcrouter._tcp.cache.example.com"}, "srv", 0)
+		So(err, ShouldBeNil)
+		var looked string
+		d.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			looked = name
+			return "", []*net.SRV{{Target: "mcrouter-1.example.com.", Port: 5000}, {Target: "mcrouter-2.example.com.", Port: 5001}}, nil
+		}
+
+		Convey("It should target the host and port of every record", func() {
+			targets, err := d.discover(context.Background())
+			So(err, ShouldBeNil)
+			So(looked, ShouldEqual, "_mcrouter._tcp.cache.example.com")
+			So(targets, ShouldResemble, []target{{address: "mcrouter-1.example.com:5000"}, {address: "mcrouter-2.example.com:5001"}})
+		})
+
+		Convey("Discovery should fail when resolution fails", func() {
+			d.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+				return "", nil, errors.New("no such host")
+			}
+			_, err := d.discover(context.Background())
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given A records", t, func() {
+		d, err := newDNSDiscovery([]string{"mcrouter.example.com"}, "A", 5000)
+		So(err, ShouldBeNil)
+		d.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("fd00::1")}}, nil
+		}
+
+		Convey("It should target every address on the configured port", func() {
+			targets, err := d.discover(context.Background())
+			So(err, ShouldBeNil)
+			So(targets, ShouldResemble, []target{{address: "10.0.0.1:5000"}, {address: "[fd00::1]:5000"}})
+		})
+	})
+
+	Convey("An unknown record type should be rejected", t, func() {
+		_, err := newDNSDiscovery([]string{"mcrouter.example.com"}, "MX", 5000)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestFleetSources(t *testing.T) {
+	Convey("Given a fleet fed by several discovery sources", t, func() {
+		created := 0
+		f := newFleet(nil, nil, func(target string) *Exporter {
+			created++
+			return NewExporter(target, time.Second, false, log.NewNopLogger())
+		}, log.NewNopLogger())
+		f.updateSource("static", staticTargets([]string{"10.0.0.1:5000"}))
+		f.updateSource("dns", []target{{address: "10.0.0.2:5000"}})
+
+		Convey("It should scrape the targets of every source", func() {
+			So(f.targets, ShouldContainKey, "10.0.0.1:5000")
+			So(f.targets, ShouldContainKey, "10.0.0.2:5000")
+		})
+
+		Convey("It should retire the targets a source no longer finds", func() {
+			f.updateSource("dns", nil)
+			So(f.targets, ShouldHaveLength, 1)
+			So(f.targets, ShouldContainKey, "10.0.0.1:5000")
+		})
+
+		Convey("It should relabel a target whose labels changed, keeping its exporter", func() {
+			before := f.targets["10.0.0.2:5000"]
+			f.updateSource("dns", []target{{address: "10.0.0.2:5000", labels: map[string]string{"zone": "a"}}})
+			So(f.targets["10.0.0.2:5000"].labels, ShouldResemble, map[string]string{"zone": "a"})
+			So(f.targets["10.0.0.2:5000"].exporter, ShouldEqual, before.exporter)
+			So(created, ShouldEqual, 2)
+		})
+
+		Convey("A target found by overlapping sources should be scraped once, with the labels of the last source", func() {
+			f.updateSource("file", []target{
+				{address: "10.0.0.1:5000", labels: map[string]string{"zone": "a"}},
+				{address: "10.0.0.3:5000", labels: map[string]string{"zone": "b"}},
+			})
+			f.updateSource("kubernetes", []target{{address: "10.0.0.3:5000", labels: map[string]string{"zone": "c"}}})
+			So(f.targets, ShouldHaveLength, 3)
+			So(f.targets["10.0.0.1:5000"].labels, ShouldBeNil)
+			So(f.targets["10.0.0.3:5000"].labels, ShouldResemble, map[string]string{"zone": "c"})
+			So(created, ShouldEqual, 3)
+		})
+
+		Convey("An address listed twice should get a single exporter", func() {
+			f.setTargets([]target{
+				{address: "10.0.0.4:5000", labels: map[string]string{"zone": "a"}},
+				{address: "10.0.0.4:5000", labels: map[string]string{"zone": "b"}},
+			})
+			So(f.targets, ShouldHaveLength, 1)
+			So(f.targets["10.0.0.4:5000"].labels, ShouldResemble, map[string]string{"zone": "b"})
+			So(created, ShouldEqual, 3)
+		})
+
+		Convey("It should skip a target whose labels collide with metric labels", func() {
+			f.updateSource("file", []target{{address: "10.0.0.3:5000", labels: map[string]string{"version": "x"}}})
+			So(f.targets, ShouldNotContainKey, "10.0.0.3:5000")
+			So(f.targets, ShouldHaveLength, 2)
+		})
+	})
+}
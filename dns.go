@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// dnsDiscovery resolves DNS names into targets, either SRV records giving
+// the host and port of each mcrouter, or A/AAAA records scraped on a fixed
+// port.
+type dnsDiscovery struct {
+	names []string
+	// Record type, SRV or A.
+	recordType string
+	// Port of the targets resolved from A records.
+	port int
+
+	lookupSRV    func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func newDNSDiscovery(names []string, recordType string, port int) (*dnsDiscovery, error) {
+	recordType = strings.ToUpper(recordType)
+	if recordType != "SRV" && recordType != "A" {
+		return nil, fmt.Errorf("unknown DNS record type %q, expected SRV or A", recordType)
+	}
+	return &dnsDiscovery{
+		names:        names,
+		recordType:   recordType,
+		port:         port,
+		lookupSRV:    net.DefaultResolver.LookupSRV,
+		lookupIPAddr: net.DefaultResolver.LookupIPAddr,
+	}, nil
+}
+
+// discover resolves every name. Discovery fails when any name fails to
+// resolve, so that a DNS outage does not retire the targets.
+func (d *dnsDiscovery) discover(ctx context.Context) ([]target, error) {
+	var targets []target
+	for _, name := range d.names {
+		if d.recordType == "SRV" {
+			_, records, err := d.lookupSRV(ctx, "", "", name)
+			if err != nil {
+				return nil, err
+			}
+			for _, srv := range records {
+				address := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+				targets = append(targets, target{address: address})
+			}
+			continue
+		}
+
+		addrs, err := d.lookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			targets = append(targets, target{address: net.JoinHostPort(addr.IP.String(), strconv.Itoa(d.port))})
+		}
+	}
+	return targets, nil
+}
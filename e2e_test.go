@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dev25/mcrouter_exporter/internal/mcroutertest"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata.")
+
+// Start a fake mcrouter serving the given script from testdata
+func startFakeMcrouter(t *testing.T, address, script string) *mcroutertest.Server {
+	replies, err := mcroutertest.LoadScript(filepath.Join("testdata", script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := mcroutertest.NewServer(address, replies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Scrape the exporter through its HTTP handler, as Prometheus would
+func scrapeMetrics(t *testing.T, e prometheus.Collector) string {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+	server := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// Drop the samples of the collector durations, which vary between runs
+func withoutDurations(metrics string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(metrics, "\n") {
+		if !strings.HasPrefix(line, "mcrouter_exporter_collector_duration_seconds{") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Compare the scraped metrics with a golden file from testdata
+func golden(t *testing.T, name, actual string) string {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(expected)
+}
+
+func TestEndToEnd(t *testing.T) {
+	Convey("Given a fake mcrouter 37 over TCP", t, func() {
+		s := startFakeMcrouter(t, "127.0.0.1:0", "mcrouter-37.script")
+		defer s.Close()
+
+		Convey("When scraped with all optional metrics enabled", func() {
+			e := NewExporter(s.Addr(), time.Second, true, log.NewNopLogger())
+			e.options = []string{"num-proxies", "server-timeout", "route-prefix"}
+			metrics := withoutDurations(scrapeMetrics(t, e))
+
+			Convey("It should match the golden file", func() {
+				So(metrics, ShouldEqual, golden(t, "mcrouter-37.metrics", metrics))
+			})
+		})
+
+		Convey("When replies are slow and split into partial lines", func() {
+			s.SetFaults(mcroutertest.Faults{Latency: 10 * time.Millisecond, ChunkSize: 7})
+			metrics := scrapeMetrics(t, NewExporter(s.Addr(), time.Second, true, log.NewNopLogger()))
+
+			Convey("It should still parse all metrics", func() {
+				So(metrics, ShouldContainSubstring, "mcrouter_up 1\n")
+				So(metrics, ShouldContainSubstring, `mcrouter_server_memcached_soft_tko{server="10.0.0.2:11211:ascii:plain:notcompressed-1000"} 1`)
+			})
+		})
+
+		Convey("When mcrouter disconnects before replying", func() {
+			s.SetFaults(mcroutertest.Faults{DisconnectAfter: 1})
+			metrics := scrapeMetrics(t, NewExporter(s.Addr(), time.Second, false, log.NewNopLogger()))
+
+			Convey("It should report mcrouter as down", func() {
+				So(metrics, ShouldEqual, "# HELP mcrouter_up Could the mcrouter server be reached.\n# TYPE mcrouter_up gauge\nmcrouter_up 0\n")
+			})
+		})
+
+		Convey("When mcrouter replies with garbage", func() {
+			s.SetFaults(mcroutertest.Faults{Garbage: true})
+			metrics := scrapeMetrics(t, NewExporter(s.Addr(), time.Second, true, log.NewNopLogger()))
+
+			Convey("It should report mcrouter as down instead of panicking", func() {
+				So(metrics, ShouldEqual, "# HELP mcrouter_up Could the mcrouter server be reached.\n# TYPE mcrouter_up gauge\nmcrouter_up 0\n")
+			})
+		})
+	})
+
+	Convey("Given a fake mcrouter 37 over a UNIX socket", t, func() {
+		s := startFakeMcrouter(t, filepath.Join(t.TempDir(), "mcrouter.sock"), "mcrouter-37.script")
+		defer s.Close()
+
+		Convey("When scraped", func() {
+			metrics := scrapeMetrics(t, NewExporter(s.Addr(), time.Second, false, log.NewNopLogger()))
+
+			Convey("It should report mcrouter as up", func() {
+				So(metrics, ShouldContainSubstring, "mcrouter_up 1\n")
+				So(metrics, ShouldContainSubstring, `mcrouter_version{version="37.0.0"} 1`)
+			})
+		})
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// targetGroup is an entry of a Prometheus file_sd file.
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// fileVersion identifies the content of a file by its modification time and
+// size, to detect changes without reading it.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// fileDiscovery reads the targets from files in the Prometheus file_sd
+// format, JSON or YAML depending on their extension. The files are only
+// parsed again when they change.
+type fileDiscovery struct {
+	// Paths of the files, which may be glob patterns.
+	patterns []string
+
+	versions map[string]fileVersion
+	targets  []target
+}
+
+func newFileDiscovery(patterns []string) (*fileDiscovery, error) {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid file pattern %q: %w", pattern, err)
+		}
+	}
+	return &fileDiscovery{patterns: patterns}, nil
+}
+
+// discover returns the targets of the files, parsing them again when files
+// were added, removed or modified since the last call.
+func (d *fileDiscovery) discover(ctx context.Context) ([]target, error) {
+	var paths []string
+	for _, pattern := range d.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	versions := make(map[string]fileVersion, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		versions[path] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+	if d.versions != nil && equalVersions(versions, d.versions) {
+		return d.targets, nil
+	}
+
+	var targets []target
+	for _, path := range paths {
+		fileTargets, err := readTargetFile(path)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, fileTargets...)
+	}
+	d.versions, d.targets = versions, targets
+	return targets, nil
+}
+
+func equalVersions(a, b map[string]fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, v := range a {
+		if w, ok := b[path]; !ok || !v.modTime.Equal(w.modTime) || v.size != w.size {
+			return false
+		}
+	}
+	return true
+}
+
+// readTargetFile parses a file_sd file into targets. Labels are validated,
+// and the target label is reserved for the address.
+func readTargetFile(path string) ([]target, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []targetGroup
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal(content, &groups)
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(content, &groups)
+	default:
+		return nil, fmt.Errorf("%s: unsupported file extension %q, expected .json, .yml or .yaml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var targets []target
+	for _, group := range groups {
+		for name := range group.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) || name == "target" {
+				return nil, fmt.Errorf("%s: invalid label name %q", path, name)
+			}
+		}
+		for _, address := range group.Targets {
+			targets = append(targets, target{address: address, labels: group.Labels})
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var configDriftDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "config_drift"),
+	"Whether the target differs from the fleet majority for the given aspect (config_md5, version or option:<name>).",
+	[]string{"target", "aspect"},
+	nil,
+)
+
+// mcrouterInfo describes the configuration of a mcrouter as seen during the
+// last successful scrape.
+type mcrouterInfo struct {
+	version   string
+	configMD5 string
+	options   map[string]string
+}
+
+// recordInfo remembers the configuration of mcrouter for drift detection.
+func (e *Exporter) recordInfo(stats map[string]string, configMD5 string, options map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.info = &mcrouterInfo{version: stats["version"], configMD5: configMD5, options: options}
+}
+
+// forgetInfo forgets the configuration of mcrouter after a failed scrape, so
+// that a target that cannot be scraped is not compared with stale
+// information.
+func (e *Exporter) forgetInfo() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.info = nil
+}
+
+// lastInfo returns the configuration recorded during the last successful
+// scrape. It is kept for the other gatherers of the fleet, e.g. a pusher
+// gathering along with the scrapes of /metrics.
+func (e *Exporter) lastInfo() *mcrouterInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.info
+}
+
+// driftOutlier is a target differing from the fleet majority.
+type driftOutlier struct {
+	Target   string
+	Aspect   string
+	Value    string
+	Majority string
+}
+
+// target is a mcrouter to scrape, along with the labels added to its series
+// besides the target address, e.g. the pod it runs in.
+type target struct {
+	address string
+	labels  map[string]string
+}
+
+// staticTargets returns the targets of a list of addresses, without labels.
+func staticTargets(addresses []string) []target {
+	targets := make([]target, 0, len(addresses))
+	for _, address := range addresses {
+		targets = append(targets, target{address: address})
+	}
+	return targets
+}
+
+// fleetTarget is a scraped mcrouter along with the registry labeling its
+// series with the target address and labels.
+type fleetTarget struct {
+	labels   map[string]string
+	exporter *Exporter
+	registry *prometheus.Registry
+}
+
+// fleet scrapes many mcrouter targets, labeling every series with the target
+// address, and compares their configuration to detect drift after rollouts.
+// It implements prometheus.Gatherer rather than prometheus.Collector, so that
+// each target is scraped through its own registry.
+type fleet struct {
+	newExporter func(target string) *Exporter
+	// Startup options compared across the fleet.
+	options []string
+	logger  log.Logger
+
+	// Targets found by each discovery source, see updateSource.
+	sourcesMu sync.Mutex
+	sources   map[string][]target
+
+	mu       sync.Mutex
+	targets  map[string]*fleetTarget
+	infos    map[string]*mcrouterInfo
+	outliers []driftOutlier
+}
+
+func newFleet(targets []target, options []string, newExporter func(target string) *Exporter, logger log.Logger) *fleet {
+	f := &fleet{
+		newExporter: newExporter,
+		options:     options,
+		logger:      logger,
+		sources:     make(map[string][]target),
+		targets:     make(map[string]*fleetTarget),
+	}
+	f.setTargets(targets)
+	return f
+}
+
+// setTargets creates exporters for new targets and retires the exporters of
+// targets that are gone. Targets whose labels changed are relabeled, keeping
+// their exporter along with the state of its trackers. When an address is
+// listed twice, its last labels are used.
+func (f *fleet) setTargets(targets []target) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current := make(map[string]*fleetTarget, len(targets))
+	for _, target := range targets {
+		t, ok := current[target.address]
+		if !ok {
+			t, ok = f.targets[target.address]
+		}
+		if ok && reflect.DeepEqual(t.labels, target.labels) {
+			current[target.address] = t
+			continue
+		}
+		labels := prometheus.Labels{"target": target.address}
+		for name, value := range target.labels {
+			labels[name] = value
+		}
+		var exporter *Exporter
+		if ok {
+			exporter = t.exporter
+		} else {
+			exporter = f.newExporter(target.address)
+			exporter.trackInfo = true
+		}
+		registry := prometheus.NewRegistry()
+		if err := prometheus.WrapRegistererWith(labels, registry).Register(exporter); err != nil {
+			// e.g. a discovered label colliding with a metric label
+			level.Error(f.logger).Log("msg", "Failed to add mcrouter target", "target", target.address, "err", err)
+			delete(current, target.address)
+			// Exporters of the previous targets are closed below
+			if previous, ok := f.targets[target.address]; !ok || previous.exporter != exporter {
+				exporter.close()
+			}
+			continue
+		}
+		current[target.address] = &fleetTarget{labels: target.labels, exporter: exporter, registry: registry}
+	}
+	for address, t := range f.targets {
+		if c, ok := current[address]; !ok || c.exporter != t.exporter {
+			t.exporter.close()
+		}
+	}
+	f.targets = current
+}
+
+// updateSource replaces the targets found by a discovery source, and
+// scrapes the targets of every source. Sources are merged in the order of
+// their names, and a target found by several sources keeps the labels of the
+// last of them.
+func (f *fleet) updateSource(source string, targets []target) {
+	f.sourcesMu.Lock()
+	defer f.sourcesMu.Unlock()
+
+	f.sources[source] = targets
+	names := make([]string, 0, len(f.sources))
+	for name := range f.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var all []target
+	index := make(map[string]int)
+	for _, name := range names {
+		for _, target := range f.sources[name] {
+			if i, ok := index[target.address]; ok {
+				all[i] = target
+				continue
+			}
+			index[target.address] = len(all)
+			all = append(all, target)
+		}
+	}
+	f.setTargets(all)
+}
+
+// Gather scrapes all targets concurrently and returns their metrics along
+// with the drift of each target. It implements prometheus.Gatherer.
+func (f *fleet) Gather() ([]*dto.MetricFamily, error) {
+	f.mu.Lock()
+	targets := make(map[string]*fleetTarget, len(f.targets))
+	for target, t := range f.targets {
+		targets[target] = t
+	}
+	f.mu.Unlock()
+
+	var (
+		wg        sync.WaitGroup
+		resultsMu sync.Mutex
+		gatherers prometheus.Gatherers
+	)
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *fleetTarget) {
+			defer wg.Done()
+			mfs, err := t.registry.Gather()
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			gatherers = append(gatherers, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return mfs, err
+			}))
+		}(t)
+	}
+	wg.Wait()
+
+	infos := make(map[string]*mcrouterInfo, len(targets))
+	for target, t := range targets {
+		if info := t.exporter.lastInfo(); info != nil {
+			infos[target] = info
+		}
+	}
+	outliers := f.drift(infos)
+	f.mu.Lock()
+	f.infos, f.outliers = infos, outliers
+	f.mu.Unlock()
+
+	driftRegistry := prometheus.NewRegistry()
+	driftRegistry.MustRegister(f)
+	return append(gatherers, driftRegistry).Gather()
+}
+
+// Describe describes the drift metric. It implements prometheus.Collector.
+func (f *fleet) Describe(ch chan<- *prometheus.Desc) {
+	ch <- configDriftDesc
+}
+
+// Collect delivers the drift of each target found by the last Gather. It
+// implements prometheus.Collector.
+func (f *fleet) Collect(ch chan<- prometheus.Metric) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	drifting := make(map[[2]string]bool, len(f.outliers))
+	for _, o := range f.outliers {
+		drifting[[2]string{o.Target, o.Aspect}] = true
+	}
+	for target := range f.infos {
+		for _, aspect := range f.aspects() {
+			v := 0.0
+			if drifting[[2]string{target, aspect}] {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(configDriftDesc, prometheus.GaugeValue, v, target, aspect)
+		}
+	}
+}
+
+// aspects lists the configuration aspects compared across the fleet.
+func (f *fleet) aspects() []string {
+	aspects := []string{"config_md5", "version"}
+	for _, option := range f.options {
+		aspects = append(aspects, "option:"+option)
+	}
+	return aspects
+}
+
+// drift compares every target to the most common value of each aspect. No
+// drift is reported for an aspect without a strict majority, e.g. two
+// targets disagreeing, since the outlier would be arbitrary.
+func (f *fleet) drift(infos map[string]*mcrouterInfo) []driftOutlier {
+	var outliers []driftOutlier
+	for _, aspect := range f.aspects() {
+		values := make(map[string]string, len(infos))
+		counts := make(map[string]int)
+		for target, info := range infos {
+			var v string
+			switch aspect {
+			case "config_md5":
+				v = info.configMD5
+			case "version":
+				v = info.version
+			default:
+				v = info.options[aspect[len("option:"):]]
+			}
+			values[target] = v
+			counts[v]++
+		}
+
+		var (
+			majority string
+			best     int
+			tie      bool
+		)
+		for v, n := range counts {
+			switch {
+			case n > best:
+				majority, best, tie = v, n, false
+			case n == best:
+				tie = true
+			}
+		}
+		if tie {
+			continue
+		}
+		for target, v := range values {
+			if v != majority {
+				outliers = append(outliers, driftOutlier{Target: target, Aspect: aspect, Value: v, Majority: majority})
+			}
+		}
+	}
+
+	sort.Slice(outliers, func(i, j int) bool {
+		if outliers[i].Target != outliers[j].Target {
+			return outliers[i].Target < outliers[j].Target
+		}
+		return outliers[i].Aspect < outliers[j].Aspect
+	})
+	return outliers
+}
+
+var driftTemplate = template.Must(template.New("drift").Parse(`<html>
+             <head><title>Mcrouter Exporter - Config Drift</title></head>
+             <body>
+             <h1>Config Drift</h1>
+             {{if .}}
+             <table border="1">
+             <tr><th>Target</th><th>Aspect</th><th>Value</th><th>Fleet majority</th></tr>
+             {{range .}}<tr><td>{{.Target}}</td><td>{{.Aspect}}</td><td>{{.Value}}</td><td>{{.Majority}}</td></tr>
+             {{end}}
+             </table>
+             {{else}}
+             <p>All targets agree with the fleet majority.</p>
+             {{end}}
+             </body>
+             </html>`))
+
+// driftHandler lists the outliers found during the last scrape.
+func (f *fleet) driftHandler(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	outliers := f.outliers
+	f.mu.Unlock()
+
+	if err := driftTemplate.Execute(w, outliers); err != nil {
+		level.Error(f.logger).Log("msg", "Failed to render drift page", "err", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFleetDrift(t *testing.T) {
+	Convey("Given a fleet of three mcrouters, one running another version", t, func() {
+		var addresses []string
+		for _, v := range []string{"37.0.0", "37.0.0", "38.0.0"} {
+			l := serveCommands(t, map[string]string{
+				"stats all":                          "STAT version " + v + "\r\nSTAT commandargs --num-proxies 4\r\nEND\r\n",
+				"get __mcrouter__.options":           "END\r\n",
+				"get __mcrouter__.config_md5_digest": "VALUE __mcrouter__.config_md5_digest 0 3\r\nabc\r\nEND\r\n",
+			})
+			defer l.Close()
+			addresses = append(addresses, l.Addr())
+		}
+
+		f := newFleet(staticTargets(addresses), []string{"num-proxies"}, func(target string) *Exporter {
+			return NewExporter(target, time.Second, false, log.NewNopLogger())
+		}, log.NewNopLogger())
+
+		Convey("When gathered", func() {
+			mfs, err := f.Gather()
+			So(err, ShouldBeNil)
+
+			values := make(map[string]float64)
+			for _, mf := range mfs {
+				for _, m := range mf.GetMetric() {
+					var labels []string
+					for _, lp := range m.GetLabel() {
+						labels = append(labels, lp.GetName()+"="+strconv.Quote(lp.GetValue()))
+					}
+					values[mf.GetName()+"{"+strings.Join(labels, ",")+"}"] = m.GetGauge().GetValue()
+				}
+			}
+
+			Convey("It should label the series of each target", func() {
+				for _, address := range addresses {
+					So(values[`mcrouter_up{target="`+address+`"}`], ShouldEqual, 1)
+				}
+			})
+
+			Convey("It should report the outlier version only", func() {
+				So(values[`mcrouter_config_drift{aspect="version",target="`+addresses[0]+`"}`], ShouldEqual, 0)
+				So(values[`mcrouter_config_drift{aspect="version",target="`+addresses[2]+`"}`], ShouldEqual, 1)
+				So(values[`mcrouter_config_drift{aspect="config_md5",target="`+addresses[2]+`"}`], ShouldEqual, 0)
+				So(values[`mcrouter_config_drift{aspect="option:num-proxies",target="`+addresses[2]+`"}`], ShouldEqual, 0)
+			})
+
+			Convey("It should list the outlier on the drift page", func() {
+				rec := httptest.NewRecorder()
+				f.driftHandler(rec, httptest.NewRequest("GET", "/drift", nil))
+				So(rec.Body.String(), ShouldContainSubstring, "<td>"+addresses[2]+"</td><td>version</td><td>38.0.0</td><td>37.0.0</td>")
+			})
+		})
+
+		Convey("When gathered concurrently, e.g. by /metrics and a pusher", func() {
+			var wg sync.WaitGroup
+			drifts := make([]int, 2)
+			for i := range drifts {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					mfs, _ := f.Gather()
+					for _, mf := range mfs {
+						if mf.GetName() == namespace+"_config_drift" {
+							drifts[i] = len(mf.GetMetric())
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			Convey("Both should report the drift of every target", func() {
+				So(drifts, ShouldResemble, []int{9, 9})
+			})
+		})
+
+		Convey("When two targets disagree without majority", func() {
+			f.setTargets(staticTargets(addresses[1:]))
+			_, err := f.Gather()
+			So(err, ShouldBeNil)
+
+			Convey("No drift should be reported", func() {
+				rec := httptest.NewRecorder()
+				f.driftHandler(rec, httptest.NewRequest("GET", "/drift", nil))
+				So(rec.Body.String(), ShouldContainSubstring, "All targets agree with the fleet majority.")
+			})
+		})
+
+		Convey("When a target is retired", func() {
+			f.setTargets(staticTargets(addresses[:2]))
+
+			Convey("It should not be scraped anymore", func() {
+				mfs, err := f.Gather()
+				So(err, ShouldBeNil)
+				for _, mf := range mfs {
+					for _, m := range mf.GetMetric() {
+						So(labelValue(m, "target"), ShouldNotEqual, addresses[2])
+					}
+				}
+			})
+		})
+	})
+}
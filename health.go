@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// healthyHandler reports that the exporter process is alive. It never talks
+// to mcrouter, so it is safe to use as a liveness probe.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Healthy.")
+}
+
+// readyHandler reports whether mcrouter is reachable and its config is not
+// failing, see ready.
+func (e *Exporter) readyHandler(maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := e.ready(maxAge); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "Ready.")
+	})
+}
+
+// ready checks whether mcrouter is reachable and its config is not failing.
+// The outcome of the last scrape is reused when it is younger than maxAge,
+// whether it succeeded or failed, otherwise mcrouter is probed with the
+// lightweight version command.
+func (e *Exporter) ready(maxAge time.Duration) error {
+	e.mu.Lock()
+	lastProbe, probeErr, configFailing := e.lastProbe, e.probeErr, e.configFailing
+	e.mu.Unlock()
+
+	if time.Since(lastProbe) > maxAge {
+		if err := e.probeVersion(); err != nil {
+			level.Warn(e.logger).Log("msg", "Readiness probe of mcrouter failed", "err", err)
+			return fmt.Errorf("mcrouter is not reachable: %w", err)
+		}
+	} else if probeErr != nil {
+		return fmt.Errorf("mcrouter is not reachable: %w", probeErr)
+	}
+	if configFailing {
+		return errors.New("mcrouter failed to apply its latest config")
+	}
+	return nil
+}
+
+// probeVersion checks that mcrouter answers the version command within the
+// configured timeout.
+func (e *Exporter) probeVersion() error {
+	c, err := e.pool.get()
+	if err != nil {
+		return err
+	}
+	if err = c.SetDeadline(time.Now().Add(e.timeout)); err == nil {
+		if err = c.send("version"); err == nil {
+			_, err = readVersion(c.reader)
+		}
+	}
+	e.pool.put(c, err)
+	if err != nil {
+		e.recordProbeFailure(err)
+		return err
+	}
+
+	e.mu.Lock()
+	e.lastProbe, e.probeErr = time.Now(), nil
+	e.mu.Unlock()
+	return nil
+}
+
+// recordProbe remembers the outcome of a successful stats scrape.
+func (e *Exporter) recordProbe(configFailing bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastProbe, e.probeErr = time.Now(), nil
+	e.configFailing = configFailing
+}
+
+// recordProbeFailure remembers that mcrouter could not be probed, so that it
+// is not reported ready until a later probe succeeds.
+func (e *Exporter) recordProbeFailure(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastProbe, e.probeErr = time.Now(), err
+}
+
+// readyHandler reports whether enough targets of the fleet are ready, as
+// checked for a single mcrouter: at least minFraction of them, and always at
+// least one. Targets are checked concurrently.
+func (f *fleet) readyHandler(maxAge time.Duration, minFraction float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		exporters := make([]*Exporter, 0, len(f.targets))
+		for _, t := range f.targets {
+			exporters = append(exporters, t.exporter)
+		}
+		f.mu.Unlock()
+
+		var (
+			wg    sync.WaitGroup
+			ready int32
+		)
+		for _, e := range exporters {
+			wg.Add(1)
+			go func(e *Exporter) {
+				defer wg.Done()
+				if e.ready(maxAge) == nil {
+					atomic.AddInt32(&ready, 1)
+				}
+			}(e)
+		}
+		wg.Wait()
+
+		required := int(math.Ceil(minFraction * float64(len(exporters))))
+		if required < 1 {
+			required = 1
+		}
+		if int(ready) < required {
+			http.Error(w, fmt.Sprintf("%d of %d mcrouter targets are ready, %d required", ready, len(exporters), required), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Ready, %d of %d mcrouter targets.\n", ready, len(exporters))
+	})
+}
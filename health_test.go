@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVersionParsing(t *testing.T) {
+	Convey("Given a remote mcrouter version endpoint", t, func() {
+		server, client := net.Pipe()
+		go func() {
+			buf := make([]byte, 1024)
+			server.Read(buf)
+			server.Write([]byte("VERSION mcrouter 37.0.0\r\n"))
+			server.Close()
+		}()
+		Convey("It should return the version string", func() {
+			v, err := getVersion(client)
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, "mcrouter 37.0.0")
+		})
+	})
+}
+
+func TestReadyHandler(t *testing.T) {
+	Convey("Given an exporter", t, func() {
+		Convey("When mcrouter answers the version command", func() {
+			l := serveCommands(t, map[string]string{"version": "VERSION mcrouter 37.0.0\r\n"})
+			defer l.Close()
+			e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+
+			rec := httptest.NewRecorder()
+			e.readyHandler(time.Minute).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+
+			Convey("And its config is failing, it should not be ready", func() {
+				e.recordProbe(true)
+				rec := httptest.NewRecorder()
+				e.readyHandler(time.Minute).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+				So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+		})
+
+		Convey("When the scrapes of mcrouter start failing", func() {
+			l := serveCommands(t, map[string]string{
+				"version":   "VERSION mcrouter 37.0.0\r\n",
+				"stats all": "STAT version 37.0.0\r\nEND\r\n",
+			})
+			defer l.Close()
+			e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+			So(gatherValues(t, e)["mcrouter_up{}"], ShouldEqual, 1)
+			l.SetReply("stats all", "SERVER_ERROR unavailable\r\n")
+			So(gatherValues(t, e)["mcrouter_up{}"], ShouldEqual, 0)
+
+			Convey("It should not be ready until a scrape succeeds again", func() {
+				rec := httptest.NewRecorder()
+				e.readyHandler(time.Minute).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+				So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+
+				l.SetReply("stats all", "STAT version 37.0.0\r\nEND\r\n")
+				So(gatherValues(t, e)["mcrouter_up{}"], ShouldEqual, 1)
+				rec = httptest.NewRecorder()
+				e.readyHandler(time.Minute).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+				So(rec.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When mcrouter replies with an error", func() {
+			l := serveCommands(t, nil)
+			defer l.Close()
+			e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+
+			rec := httptest.NewRecorder()
+			e.readyHandler(time.Minute).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+			So(rec.Code, ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("The liveness endpoint should always succeed", func() {
+			rec := httptest.NewRecorder()
+			healthyHandler(rec, httptest.NewRequest("GET", "/-/healthy", nil))
+			So(rec.Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
+
+func TestFleetReadyHandler(t *testing.T) {
+	Convey("Given a fleet of a reachable and an unreachable mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{"version": "VERSION mcrouter 37.0.0\r\n"})
+		defer l.Close()
+		f := newFleet(staticTargets([]string{l.Addr(), "127.0.0.1:1"}), nil, func(target string) *Exporter {
+			return NewExporter(target, time.Second, false, log.NewNopLogger())
+		}, log.NewNopLogger())
+		ready := func(minFraction float64) int {
+			rec := httptest.NewRecorder()
+			f.readyHandler(time.Minute, minFraction).ServeHTTP(rec, httptest.NewRequest("GET", "/-/ready", nil))
+			return rec.Code
+		}
+
+		Convey("It should be ready while enough targets are", func() {
+			So(ready(0), ShouldEqual, http.StatusOK)
+			So(ready(0.5), ShouldEqual, http.StatusOK)
+			So(ready(1), ShouldEqual, http.StatusServiceUnavailable)
+		})
+
+		Convey("It should not be ready without any target", func() {
+			f.setTargets(nil)
+			So(ready(0), ShouldEqual, http.StatusServiceUnavailable)
+		})
+	})
+}
@@ -0,0 +1,120 @@
+package mcroutertest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ReadScript parses a script of commands and their replies. Each command is
+// introduced by a line starting with "> " and followed by the lines of its
+// reply; lines starting with "#" are comments. Replies are stored with the
+// \r\n line endings of the mcrouter protocol, except for lines holding a Go
+// quoted string which are added verbatim, e.g.
+//
+//	# mcrouter 37.0.0
+//	> stats all
+//	STAT version 37.0.0
+//	END
+func ReadScript(r io.Reader) (map[string]string, error) {
+	replies := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var (
+		command string
+		reply   strings.Builder
+	)
+	flush := func() {
+		if command != "" {
+			replies[command] = reply.String()
+		}
+		reply.Reset()
+	}
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, "> "):
+			flush()
+			command = strings.TrimPrefix(line, "> ")
+		case strings.HasPrefix(line, "#"):
+		case command == "":
+			if line != "" {
+				return nil, fmt.Errorf("line %d: reply before any command", n)
+			}
+		case strings.HasPrefix(line, `"`):
+			raw, err := strconv.Unquote(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			reply.WriteString(raw)
+		default:
+			reply.WriteString(line + "\r\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return replies, nil
+}
+
+// LoadScript reads a script from a file, see ReadScript.
+func LoadScript(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadScript(f)
+}
+
+// WriteScript writes commands and their replies in the format read by
+// ReadScript, sorted by command. Replies that cannot be represented as plain
+// \r\n terminated lines are written as a single quoted string.
+func WriteScript(w io.Writer, replies map[string]string) error {
+	commands := make([]string, 0, len(replies))
+	for command := range replies {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	bw := bufio.NewWriter(w)
+	for _, command := range commands {
+		fmt.Fprintf(bw, "> %s\n", command)
+		if !isPlain(replies[command]) {
+			fmt.Fprintln(bw, strconv.Quote(replies[command]))
+			continue
+		}
+		reply := strings.TrimSuffix(replies[command], "\r\n")
+		for _, line := range strings.Split(reply, "\r\n") {
+			fmt.Fprintln(bw, line)
+		}
+	}
+	return bw.Flush()
+}
+
+// isPlain reports whether reply is made of printable \r\n terminated lines
+// that do not look like commands, comments or quoted strings.
+func isPlain(reply string) bool {
+	if !strings.HasSuffix(reply, "\r\n") {
+		return false
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n") {
+		if line == "" || strings.HasPrefix(line, "> ") || strings.HasPrefix(line, "#") || strings.HasPrefix(line, `"`) {
+			return false
+		}
+		for _, r := range line {
+			if !unicode.IsPrint(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+// Package mcroutertest provides a fake mcrouter serving scripted replies to
+// the stats and service info commands, with optional fault injection, for
+// use in tests and demos.
+package mcroutertest
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults describes the misbehaviours injected by a Server.
+type Faults struct {
+	// Latency delays every reply.
+	Latency time.Duration
+	// DisconnectAfter closes the connection after that many commands were
+	// received, without replying to the last one. Zero never disconnects.
+	DisconnectAfter int
+	// Garbage replaces every reply with bytes that are not valid mcrouter
+	// protocol.
+	Garbage bool
+	// ChunkSize splits replies into writes of at most that many bytes, so
+	// that clients receive partial lines. Zero writes replies at once.
+	ChunkSize int
+}
+
+// Garbage is the reply sent instead of the scripted one when Faults.Garbage
+// is set.
+const Garbage = "\x00\xffnot mcrouter\r\nSTAT\r\nSTAT x\r\n"
+
+// Server is a fake mcrouter listening on TCP or a UNIX socket. Commands are
+// answered with the reply scripted for them, or ERROR when there is none.
+type Server struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	replies map[string]string
+	faults  Faults
+	conns   map[net.Conn]bool
+}
+
+// NewServer starts a fake mcrouter listening on address. The network is
+// "unix" when the address contains a '/', as for the exporter, and "tcp"
+// otherwise.
+func NewServer(address string, replies map[string]string) (*Server, error) {
+	network := "tcp"
+	if strings.Contains(address, "/") {
+		network = "unix"
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener: l,
+		replies:  make(map[string]string),
+		conns:    make(map[net.Conn]bool),
+	}
+	for command, reply := range replies {
+		s.replies[command] = reply
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on, suitable for
+// -mcrouter.address.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// SetReply scripts the reply to a command, e.g. "stats all".
+func (s *Server) SetReply(command, reply string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies[command] = reply
+}
+
+// SetFaults changes the faults injected on new and existing connections.
+func (s *Server) SetFaults(f Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = f
+}
+
+// Close stops listening, closes all connections and waits for them to be
+// done.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for commands := 1; ; commands++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimRight(line, "\r\n")
+
+		s.mu.Lock()
+		reply, ok := s.replies[command]
+		faults := s.faults
+		s.mu.Unlock()
+
+		if faults.DisconnectAfter > 0 && commands >= faults.DisconnectAfter {
+			return
+		}
+		if !ok {
+			reply = "ERROR\r\n"
+		}
+		if faults.Garbage {
+			reply = Garbage
+		}
+		time.Sleep(faults.Latency)
+
+		if err := write(conn, []byte(reply), faults.ChunkSize); err != nil {
+			return
+		}
+	}
+}
+
+// write sends b in chunks of at most size bytes, pausing between them so
+// that they are received separately.
+func write(conn net.Conn, b []byte, size int) error {
+	if size <= 0 {
+		_, err := conn.Write(b)
+		return err
+	}
+	for len(b) > 0 {
+		n := size
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := conn.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
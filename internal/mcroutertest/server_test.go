@@ -0,0 +1,75 @@
+package mcroutertest
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScript(t *testing.T) {
+	Convey("Given scripted replies", t, func() {
+		replies := map[string]string{
+			"stats all":                "STAT version 37.0.0\r\nEND\r\n",
+			"get __mcrouter__.options": "VALUE __mcrouter__.options 0 13\r\nnum_proxies 2\nport 5000\r\nEND\r\n",
+		}
+
+		Convey("They should survive a round trip through a script", func() {
+			var buf bytes.Buffer
+			So(WriteScript(&buf, replies), ShouldBeNil)
+			read, err := ReadScript(&buf)
+			So(err, ShouldBeNil)
+			So(read, ShouldResemble, replies)
+		})
+	})
+}
+
+func TestServer(t *testing.T) {
+	Convey("Given a fake mcrouter on a UNIX socket", t, func() {
+		s, err := NewServer(filepath.Join(t.TempDir(), "mcrouter.sock"), map[string]string{
+			"stats all": "STAT version 37.0.0\r\nEND\r\n",
+		})
+		So(err, ShouldBeNil)
+		defer s.Close()
+
+		conn, err := net.Dial("unix", s.Addr())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		Convey("It should answer several commands on one connection", func() {
+			conn.Write([]byte("stats all\r\nstats nothing\r\nstats all\r\n"))
+			var lines []string
+			for i := 0; i < 5; i++ {
+				line, err := reader.ReadString('\n')
+				So(err, ShouldBeNil)
+				lines = append(lines, line)
+			}
+			So(strings.Join(lines, ""), ShouldEqual, "STAT version 37.0.0\r\nEND\r\nERROR\r\nSTAT version 37.0.0\r\nEND\r\n")
+		})
+
+		Convey("It should inject latency and partial writes", func() {
+			s.SetFaults(Faults{Latency: 50 * time.Millisecond, ChunkSize: 3})
+			start := time.Now()
+			conn.Write([]byte("stats all\r\n"))
+			line, err := reader.ReadString('\n')
+			So(err, ShouldBeNil)
+			So(line, ShouldEqual, "STAT version 37.0.0\r\n")
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+		})
+
+		Convey("It should disconnect after the configured number of commands", func() {
+			s.SetFaults(Faults{DisconnectAfter: 2})
+			conn.Write([]byte("stats all\r\nstats all\r\n"))
+			reader.ReadString('\n')
+			reader.ReadString('\n')
+			_, err := reader.ReadString('\n')
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Location of the service account credentials mounted in pods.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// podList is the subset of the Kubernetes PodList used for discovery.
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			NodeName   string `json:"nodeName"`
+			Containers []struct {
+				Ports []struct {
+					Name          string `json:"name"`
+					ContainerPort int    `json:"containerPort"`
+				} `json:"ports"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// podDiscovery lists the pods matching a label selector through the
+// Kubernetes API, and targets the mcrouter port of the running ones.
+type podDiscovery struct {
+	client    *http.Client
+	apiServer string
+	token     string
+	// Namespace of the pods, empty for all namespaces.
+	namespace string
+	selector  string
+	// Number or name of the container port of mcrouter.
+	port string
+}
+
+// newPodDiscovery configures pod discovery from the service account of the
+// pod the exporter runs in, unless apiServer is set, in which case the API
+// is reached without credentials (e.g. through kubectl proxy).
+func newPodDiscovery(apiServer, namespace, selector, port string, timeout time.Duration) (*podDiscovery, error) {
+	d := &podDiscovery{
+		client:    &http.Client{Timeout: timeout},
+		apiServer: strings.TrimSuffix(apiServer, "/"),
+		namespace: namespace,
+		selector:  selector,
+		port:      port,
+	}
+	if d.apiServer != "" {
+		return d, nil
+	}
+
+	host, servicePort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || servicePort == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, set the API server address")
+	}
+	d.apiServer = "https://" + net.JoinHostPort(host, servicePort)
+
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	d.token = strings.TrimSpace(string(token))
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	d.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return d, nil
+}
+
+// discover lists the pods and returns a target for each running pod, labeled
+// with its namespace, name and node.
+func (d *podDiscovery) discover(ctx context.Context) ([]target, error) {
+	path := "/api/v1/pods"
+	if d.namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(d.namespace) + "/pods"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.apiServer+path+"?"+url.Values{"labelSelector": {d.selector}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing pods: unexpected status %s", resp.Status)
+	}
+	var pods podList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, fmt.Errorf("listing pods: %w", err)
+	}
+
+	var targets []target
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		port := d.port
+		if _, err := strconv.Atoi(port); err != nil {
+			// Named port, looked up in the containers of the pod
+			port = ""
+			for _, c := range pod.Spec.Containers {
+				for _, p := range c.Ports {
+					if p.Name == d.port {
+						port = strconv.Itoa(p.ContainerPort)
+					}
+				}
+			}
+			if port == "" {
+				continue
+			}
+		}
+		targets = append(targets, target{
+			address: net.JoinHostPort(pod.Status.PodIP, port),
+			labels: map[string]string{
+				"namespace": pod.Metadata.Namespace,
+				"pod":       pod.Metadata.Name,
+				"node":      pod.Spec.NodeName,
+			},
+		})
+	}
+	return targets, nil
+}
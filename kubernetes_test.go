@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Pods of a mcrouter DaemonSet as listed by the Kubernetes API
+const podListJSON = `{
+  "kind": "PodList",
+  "items": [
+    {
+      "metadata": {"name": "mcrouter-abcde", "namespace": "cache"},
+      "spec": {"nodeName": "node-1", "containers": [{"name": "mcrouter", "ports": [{"name": "mcrouter", "containerPort": 5000}]}]},
+      "status": {"phase": "Running", "podIP": "10.0.0.1"}
+    },
+    {
+      "metadata": {"name": "mcrouter-fghij", "namespace": "cache"},
+      "spec": {"nodeName": "node-2", "containers": [{"name": "mcrouter", "ports": [{"name": "mcrouter", "containerPort": 5001}]}]},
+      "status": {"phase": "Running", "podIP": "10.0.0.2"}
+    },
+    {
+      "metadata": {"name": "mcrouter-klmno", "namespace": "cache"},
+      "spec": {"nodeName": "node-3", "containers": [{"name": "mcrouter"}]},
+      "status": {"phase": "Pending"}
+    }
+  ]
+}`
+
+func TestPodDiscovery(t *testing.T) {
+	Convey("Given a Kubernetes API server", t, func() {
+		var path, selector, authorization string
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, selector, authorization = r.URL.Path, r.URL.Query().Get("labelSelector"), r.Header.Get("Authorization")
+			w.Write([]byte(podListJSON))
+		}))
+		defer api.Close()
+
+		d, err := newPodDiscovery(api.URL, "cache", "app=mcrouter", "mcrouter", time.Second)
+		So(err, ShouldBeNil)
+		d.token = "secret"
+
+		Convey("When discovering the pods", func() {
+			targets, err := d.discover(context.Background())
+			So(err, ShouldBeNil)
+
+			Convey("It should list the pods of the namespace matching the selector", func() {
+				So(path, ShouldEqual, "/api/v1/namespaces/cache/pods")
+				So(selector, ShouldEqual, "app=mcrouter")
+				So(authorization, ShouldEqual, "Bearer secret")
+			})
+
+			Convey("It should target the named port of the running pods", func() {
+				So(targets, ShouldResemble, []target{
+					{address: "10.0.0.1:5000", labels: map[string]string{"namespace": "cache", "pod": "mcrouter-abcde", "node": "node-1"}},
+					{address: "10.0.0.2:5001", labels: map[string]string{"namespace": "cache", "pod": "mcrouter-fghij", "node": "node-2"}},
+				})
+			})
+		})
+
+		Convey("When discovering the pods of all namespaces on a numeric port", func() {
+			d.namespace, d.port = "", "11211"
+			targets, err := d.discover(context.Background())
+			So(err, ShouldBeNil)
+			So(path, ShouldEqual, "/api/v1/pods")
+			So(targets[0].address, ShouldEqual, "10.0.0.1:11211")
+		})
+	})
+
+	Convey("Given an API server denying access", t, func() {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}))
+		defer api.Close()
+		d, _ := newPodDiscovery(api.URL, "", "app=mcrouter", "5000", time.Second)
+
+		Convey("Discovery should fail", func() {
+			_, err := d.discover(context.Background())
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "403")
+		})
+	})
+
+	Convey("Given a fleet fed by pod discovery", t, func() {
+		l := serveCommands(t, map[string]string{"stats all": "STAT version 37.0.0\r\nEND\r\n"})
+		defer l.Close()
+		host, port, _ := strings.Cut(l.Addr(), ":")
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"items": [{"metadata": {"name": "mcrouter-abcde", "namespace": "cache"}, "spec": {"nodeName": "node-1"},
+				"status": {"phase": "Running", "podIP": "` + host + `"}}]}`))
+		}))
+		defer api.Close()
+
+		d, err := newPodDiscovery(api.URL, "cache", "app=mcrouter", port, time.Second)
+		So(err, ShouldBeNil)
+		f := newFleet(nil, nil, func(target string) *Exporter {
+			return NewExporter(target, time.Second, false, log.NewNopLogger())
+		}, log.NewNopLogger())
+		targets, err := d.discover(context.Background())
+		So(err, ShouldBeNil)
+		f.updateSource("kubernetes", targets)
+
+		Convey("Every series should be labeled with the pod", func() {
+			mfs, err := f.Gather()
+			So(err, ShouldBeNil)
+			labels := make(map[string]string)
+			for _, mf := range mfs {
+				if mf.GetName() != "mcrouter_up" {
+					continue
+				}
+				for _, lp := range mf.GetMetric()[0].GetLabel() {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				So(mf.GetMetric()[0].GetGauge().GetValue(), ShouldEqual, 1)
+			}
+			So(labels, ShouldResemble, map[string]string{
+				"namespace": "cache", "pod": "mcrouter-abcde", "node": "node-1", "target": host + ":" + port,
+			})
+		})
+	})
+}
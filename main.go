@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"math"
@@ -10,6 +11,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
@@ -23,13 +25,58 @@ import (
 
 const (
 	namespace = "mcrouter"
+
+	// Default deadline of a scrape, see -mcrouter.read_timeout.
+	defaultReadTimeout = 10 * time.Second
 )
 
 type Exporter struct {
-	server       string
-	timeout      time.Duration
-	server_stats bool
-	logger       log.Logger
+	server  string
+	timeout time.Duration
+	logger  log.Logger
+
+	// Optional collectors enabled by name, see registerCollector, and their
+	// timeouts when they differ from defaultCollectorTimeout.
+	collectors        map[string]bool
+	collectorTimeouts map[string]time.Duration
+
+	// Optional filter applied to the per-server metrics, nil exports all
+	// servers.
+	serverFilter *serverFilter
+
+	// Startup options exported as info metrics, normalized by
+	// parseOptionList.
+	options []string
+
+	// Connections to mcrouter, reused across scrapes.
+	pool *connPool
+	// Deadline of a scrape, from sending the commands to reading the last
+	// reply.
+	readTimeout time.Duration
+
+	// Remember the config digest, version and startup options of mcrouter
+	// on each scrape, for drift detection across a fleet.
+	trackInfo bool
+
+	// Outcome of the most recent probe of mcrouter, used by the readiness
+	// endpoint: its time, and its error when it failed.
+	mu            sync.Mutex
+	lastProbe     time.Time
+	probeErr      error
+	configFailing bool
+	info          *mcrouterInfo
+
+	// Restarts and config reloads of mcrouter, detected across scrapes.
+	restarts restartTracker
+	reloads  reloadTracker
+
+	// TKO transitions observed by the background polling, nil when it is
+	// disabled.
+	tko         *tkoTracker
+	stopPolling context.CancelFunc
+	// Histograms of the latencies sampled by the background polling, nil
+	// when it is disabled or without histograms.
+	samples *latencySampler
 
 	up                            *prometheus.Desc
 	startTime                     *prometheus.Desc
@@ -72,6 +119,8 @@ type Exporter struct {
 	serverProxyReqsProcessing     *prometheus.Desc
 	serverProxyInflightReqs       *prometheus.Desc
 	serverProxyRetransRatio       *prometheus.Desc
+	serverRetransRatio            *prometheus.Desc
+	serverConnections             *prometheus.Desc
 	serverMemcachedStored         *prometheus.Desc
 	serverMemcachedNotStored      *prometheus.Desc
 	serverMemcachedFound          *prometheus.Desc
@@ -88,11 +137,24 @@ type Exporter struct {
 
 // NewExporter returns an initialized exporter.
 func NewExporter(server string, timeout time.Duration, server_stats bool, logger log.Logger) *Exporter {
+	collectors := make(map[string]bool, len(collectorFactories))
+	for name, f := range collectorFactories {
+		collectors[name] = f.defaultEnabled
+	}
+	collectors["servers"] = server_stats
+
+	// Keep a connection for stats all and each collector running alongside
+	pool := newConnPool(server, timeout)
+	pool.size = 1 + len(collectorFactories)
+
 	return &Exporter{
-		server:       server,
-		timeout:      timeout,
-		server_stats: server_stats,
-		logger:       logger,
+		server:            server,
+		timeout:           timeout,
+		logger:            logger,
+		collectors:        collectors,
+		collectorTimeouts: make(map[string]time.Duration),
+		pool:              pool,
+		readTimeout:       defaultReadTimeout,
 
 		up: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "up"),
@@ -341,6 +403,18 @@ func NewExporter(server string, timeout time.Duration, server_stats bool, logger
 			[]string{"server"},
 			nil,
 		),
+		serverRetransRatio: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "server_retrans_ratio"),
+			"Average, minimum and maximum retransmission ratio of the connections to the server (per-server metric).",
+			[]string{"server", "stat"},
+			nil,
+		),
+		serverConnections: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "server_connections"),
+			"Number of connections to the server drilled down by state (per-server metric).",
+			[]string{"server", "state"},
+			nil,
+		),
 		serverMemcachedStored: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "server_memcached_stored_count"),
 			"Number of memcached STORED replies (per-server metric).",
@@ -422,6 +496,7 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.up
 	ch <- e.startTime
 	ch <- e.version
+	ch <- e.commandArgs
 	ch <- e.commands
 	ch <- e.commandCount
 	ch <- e.commandOut
@@ -435,6 +510,7 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.devNullRequests
 	ch <- e.duration
 	ch <- e.fibersAllocated
+	ch <- e.fibersPoolSize
 	ch <- e.proxyReqsProcessing
 	ch <- e.proxyReqsWaiting
 	ch <- e.requests
@@ -454,56 +530,54 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.asynclogRequests
 	ch <- e.asynclogRequestsRate
 	ch <- e.asynclogSpoolSuccessRate
+	ch <- restartsDesc
+	ch <- uptimeDesc
+	ch <- lastRestartDesc
+	ch <- configReloadsDesc
+	ch <- configAgeDesc
+	ch <- configFailingDesc
+	if e.tko != nil {
+		ch <- tkoTransitionsDesc
+		ch <- tkoSecondsDesc
+	}
+	if e.samples != nil {
+		e.samples.describe(ch)
+	}
 
-	if e.server_stats {
-		ch <- e.serverDuration
-		ch <- e.serverProxyReqsProcessing
-		ch <- e.serverProxyInflightReqs
-		ch <- e.serverProxyRetransRatio
-		ch <- e.serverMemcachedStored
-		ch <- e.serverMemcachedNotStored
-		ch <- e.serverMemcachedFound
-		ch <- e.serverMemcachedNotFound
-		ch <- e.serverMemcachedDeleted
-		ch <- e.serverMemcachedTouched
-		ch <- e.serverMemcachedExists
-		ch <- e.serverMemcachedRemoteError
-		ch <- e.serverMemcachedConnectTimeout
-		ch <- e.serverMemcachedTimeout
-		ch <- e.serverMemcachedSoftTKO
-		ch <- e.serverMemcachedHardTKO
+	collectors := e.enabledCollectors()
+	for _, c := range collectors {
+		c.describe(ch)
+	}
+	if len(collectors) > 0 {
+		ch <- collectorSuccessDesc
+		ch <- collectorDurationDesc
 	}
 }
 
 // Collect fetches the statistics from the configured mcrouter server, and
 // delivers them as Prometheus metrics. It implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-
-	network := "tcp"
-	if strings.Contains(e.server, "/") {
-		network = "unix"
-	}
-
-	conn, err := net.DialTimeout(network, e.server, e.timeout)
-	if err != nil {
-		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
-		level.Error(e.logger).Log("msg", "Failed to collect stats from mcrouter", "err", err)
-		return
-	}
-	defer conn.Close()
-
-	s, err := getStats(conn)
-
+	s, err := e.scrapeStats()
 	if err != nil {
+		e.forgetInfo()
+		e.recordProbeFailure(err)
 		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
 		level.Error(e.logger).Log("msg", "Failed to collect stats from mcrouter", "err", err)
 		return
 	}
 
 	ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 1)
+	e.recordProbe(e.parse(s, "config_last_attempt") > e.parse(s, "config_last_success"))
 
 	// Parse basic stats
 	ch <- prometheus.MustNewConstMetric(e.startTime, prometheus.CounterValue, e.parse(s, "start_time"))
+	e.collectRestarts(s, ch)
+	if e.tko != nil {
+		e.tko.collect(ch)
+	}
+	if e.samples != nil {
+		e.samples.collect(ch)
+	}
 	ch <- prometheus.MustNewConstMetric(e.version, prometheus.GaugeValue, 1, s["version"])
 	ch <- prometheus.MustNewConstMetric(e.commandArgs, prometheus.GaugeValue, 1, s["commandargs"])
 
@@ -540,6 +614,7 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 		e.configLastAttempt, prometheus.GaugeValue, e.parse(s, "config_last_attempt"))
 	ch <- prometheus.MustNewConstMetric(
 		e.configLastSuccess, prometheus.GaugeValue, e.parse(s, "config_last_success"))
+	e.collectReloads(s, ch)
 
 	// Request
 	for _, op := range []string{"error", "replied", "sent", "success"} {
@@ -587,51 +662,24 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(e.asynclogRequestsRate, prometheus.GaugeValue, e.parse(s, "asynclog_requests_rate"))
 	ch <- prometheus.MustNewConstMetric(e.asynclogSpoolSuccessRate, prometheus.GaugeValue, e.parse(s, "asynclog_spool_success_rate"))
 
-	if e.server_stats {
-		// Per-server stats
-		s1, err := getServerStats(conn)
+	e.runCollectors(e.enabledCollectors(), s, ch)
+}
 
-		if err != nil {
-			ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
-			level.Error(e.logger).Log("msg", "Failed to collect server stats from mcrouter", "err", err)
-			return
-		}
+// scrapeStats gets stats all on a connection of the pool.
+func (e *Exporter) scrapeStats() (stats map[string]string, err error) {
+	c, err := e.pool.get()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { e.pool.put(c, err) }()
 
-		for server, metrics := range s1 {
-			ch <- prometheus.MustNewConstMetric(
-				e.serverDuration, prometheus.GaugeValue, e.parse(metrics, "avg_latency_us"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverProxyReqsProcessing, prometheus.GaugeValue, e.parse(metrics, "pending_reqs"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverProxyInflightReqs, prometheus.GaugeValue, e.parse(metrics, "inflight_reqs"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverProxyRetransRatio, prometheus.GaugeValue, e.parse(metrics, "avg_retrans_ratio"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedStored, prometheus.CounterValue, e.parse(metrics, "stored"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedNotStored, prometheus.CounterValue, e.parse(metrics, "notstored"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedFound, prometheus.CounterValue, e.parse(metrics, "found"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedNotFound, prometheus.CounterValue, e.parse(metrics, "notfound"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedDeleted, prometheus.CounterValue, e.parse(metrics, "deleted"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedTouched, prometheus.CounterValue, e.parse(metrics, "touched"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedExists, prometheus.CounterValue, e.parse(metrics, "exists"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedRemoteError, prometheus.CounterValue, e.parse(metrics, "remote_error"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedConnectTimeout, prometheus.CounterValue, e.parse(metrics, "connect_timeout"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedTimeout, prometheus.CounterValue, e.parse(metrics, "timeout"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedSoftTKO, prometheus.GaugeValue, e.parse(metrics, "soft_tko"), server)
-			ch <- prometheus.MustNewConstMetric(
-				e.serverMemcachedHardTKO, prometheus.GaugeValue, e.parse(metrics, "hard_tko"), server)
-		}
+	if err = c.SetDeadline(time.Now().Add(e.readTimeout)); err != nil {
+		return nil, err
+	}
+	if err = c.send("stats all"); err != nil {
+		return nil, err
 	}
+	return parseStats(c.reader, "stats all")
 }
 
 // Parse a string into a 64 bit float suitable for  Prometheus
@@ -650,146 +698,104 @@ func (e *Exporter) parse(stats map[string]string, key string) float64 {
 
 // Get stats from mcrouter using a basic TCP connection
 func getStats(conn net.Conn) (map[string]string, error) {
-	m := make(map[string]string)
-	fmt.Fprintf(conn, "stats all\r\n")
-	reader := bufio.NewReader(conn)
-
-	// Iterate over the lines and extract the metric name and value(s)
-	// example lines:
-	// 	 [STAT version 37.0.0
-	//	 [STAT commandargs --option1 value --flag2
-	//	 END
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
+	return getStatsGroup(conn, "all")
+}
 
-		if line == "END\r\n" {
-			break
-		}
+// Get a group of stats (e.g. all, detailed) from mcrouter using a basic TCP
+// connection
+func getStatsGroup(conn net.Conn, group string) (map[string]string, error) {
+	c := newMcrouterConn(conn)
+	if err := c.send("stats " + group); err != nil {
+		return nil, err
+	}
+	return parseStats(c.reader, "stats "+group)
+}
 
-		// Split the line into 3 components, anything after the metric name should
-		// be considered as the metric value.
-		result := strings.SplitN(line, " ", 3)
-		value := strings.TrimRight(result[2], "\r\n")
-		m[result[1]] = value
+// Get the mcrouter version using the lightweight version command
+func getVersion(conn net.Conn) (string, error) {
+	c := newMcrouterConn(conn)
+	if err := c.send("version"); err != nil {
+		return "", err
 	}
+	return readVersion(c.reader)
+}
 
-	return m, nil
+// Read the reply to the version command, e.g.
+//
+//	VERSION mcrouter 37.0.0
+func readVersion(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", &truncatedError{command: "version", err: err}
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "VERSION ") {
+		return "", fmt.Errorf("unexpected reply to version command: %q", line)
+	}
+	return strings.TrimPrefix(line, "VERSION "), nil
 }
 
 // Get detailed per-server stats from mcrouter using a basic TCP connection
 func getServerStats(conn net.Conn) (map[string]map[string]string, error) {
-	m := make(map[string]map[string]string)
-	fmt.Fprintf(conn, "stats servers\r\n")
-	reader := bufio.NewReader(conn)
-
-	// Iterate over the lines and extract the metric name and value(s)
-	// example lines:
-	// 	 STAT 10.64.16.110:11211:ascii:plain:notcompressed-1000 avg_latency_us:302.991
-	//        pending_reqs:0 inflight_reqs:0 avg_retrans_ratio:0 max_retrans_ratio:0
-	//        min_retrans_ratio:0 up:5; deleted:4875 touched:33069 found:112675373
-	//        notfound:3493823 notstored:149776 stored:3250883 exists:2653 remote_error:32
-	//	 END
-	// In the same line there are two type of info:
-	// * per-server stats about latency, requests, etc.. up to the ';' - (ProxyDestinationBase states)
-	// * per-server breakdown of the memcached responses (STORED, DELETED, etc..) - (Carbon results)
-	//   The memcached responses are listed in carbon_result.thrift, and they are returned/appended only
-	//   when > 0. Special logic needs to be implemented then to set the ones not diplayed to zero,
-	//   since Prometheus doesn't really like metrics appearing/disappearing.
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			return nil, err
-		}
-
-		if line == "END\r\n" {
-			break
-		}
-
-		line_sanitized := strings.TrimRight(line, "\r\n")
-
-		// Split the line in 2 macro-components
-		result := strings.SplitN(line_sanitized, ";", 2)
-
-		server_metrics := strings.Split(strings.Trim(result[0], " "), " ")
-
-		// WARNING: the memcached's result states (from ';' onward) might not be
-		// available all the times, since they are added only if some data is present.
-		// There are use cases, like mcrouter just started without any commands processed,
-		// that do not expose any result. The exporter needs to add some defensive code
-		// to avoid panic states.
-		memcached_responses_metrics := []string{}
-		if len(result) == 2 {
-			memcached_responses_metrics = strings.Split(strings.Trim(result[1], " "), " ")
-		}
-
-		// The server id is always the second element of the row (after STAT),
-		// and it will be used as label in all the metrics
-		server_id := server_metrics[1]
-		m[server_id] = make(map[string]string)
-
-		// The following for loops assume that the two lines to parse
-		// have the format: metric1:value1 metric2:value2 etc..
-		// There are some special cases:
-		// 1) the server_id string is the only exception since it is composed
-		//    by more than one ':'.
-		// 2) 'soft_tko' and 'hard_tko' are server flags that appear only when one
-		//     shard is marked with that state, so they can be present or not
-		//     depending on the runtime environment. To keep a stable metric,
-		//     their values are initialized to 0 and turned to 1 only when the
-		//     flag is found.
-		SOFT_TKO_STATE := "soft_tko"
-		HARD_TKO_STATE := "hard_tko"
-		m[server_id][SOFT_TKO_STATE] = "0"
-		m[server_id][HARD_TKO_STATE] = "0"
-		for i := 2; i < len(server_metrics); i++ {
-			if server_metrics[i] == SOFT_TKO_STATE || server_metrics[i] == HARD_TKO_STATE {
-				m[server_id][server_metrics[i]] = "1"
-			} else {
-				metric_value := strings.SplitN(server_metrics[i], ":", 2)
-				if len(metric_value) == 2 {
-					m[server_id][metric_value[0]] = metric_value[1]
-				}
-			}
-		}
-
-		// See carbon_result.thrift in mcrouter's codebase
-		// and also https://github.com/facebook/mcrouter/wiki/Error-Handling
-		memcached_states := []string{"deleted", "touched", "found", "notfound", "notstored", "stored",
-			"exists", "timeout", "connect_timeout", "remote_error",
-		}
-
-		// Set all the metrics to zero to create a baseline. mcrouter reports only
-		// the states that have values > 0, but Prometheus doesn't like metrics
-		// appearing and disappearing.
-		for _, state := range memcached_states {
-			m[server_id][state] = "0"
-		}
-
-		for i := 0; i < len(memcached_responses_metrics); i++ {
-			metric_value := strings.SplitN(memcached_responses_metrics[i], ":", 2)
-			if len(metric_value) == 2 {
-				m[server_id][metric_value[0]] = metric_value[1]
-			}
-		}
+	c := newMcrouterConn(conn)
+	if err := c.send("stats servers"); err != nil {
+		return nil, err
 	}
-
-	return m, nil
+	return parseServerStats(c.reader, "stats servers")
 }
 
 func main() {
 	var (
-		address       = flag.String("mcrouter.address", "localhost:5000", "mcrouter server TCP address (tcp4/tcp6) or UNIX socket path")
-		timeout       = flag.Duration("mcrouter.timeout", time.Second, "mcrouter connect timeout.")
-		showVersion   = flag.Bool("version", false, "Print version information.")
-		listenAddress = flag.String("web.listen-address", ":9442", "Address to listen on for web interface and telemetry.")
-		metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
-		serverMetrics = flag.Bool("mcrouter.server_metrics", false, "Collect per-server metrics.")
-		logLevel      = flag.String(promlogflag.LevelFlagName, "info", promlogflag.LevelFlagHelp)
-		logFormat     = flag.String(promlogflag.FormatFlagName, "logfmt", promlogflag.FormatFlagHelp)
+		address        = flag.String("mcrouter.address", "localhost:5000", "mcrouter server TCP address (tcp4/tcp6) or UNIX socket path")
+		timeout        = flag.Duration("mcrouter.timeout", time.Second, "mcrouter connect timeout.")
+		readTimeout    = flag.Duration("mcrouter.read_timeout", defaultReadTimeout, "Deadline of a scrape of mcrouter, from sending the stats commands to reading the last reply.")
+		keepAlive      = flag.Duration("mcrouter.keepalive", 30*time.Second, "TCP keepalive period of the persistent connection to mcrouter.")
+		pollInterval   = flag.Duration("mcrouter.poll_interval", 0, "Interval of the background polling of mcrouter, e.g. 1s, to observe the TKO transitions and sample the latencies between scrapes. Disabled when 0.")
+		tkoHistory     = flag.Int("mcrouter.tko_history", 256, "Number of recent TKO transitions listed on /debug/tko.")
+		bucketFactor   = flag.Float64("mcrouter.histogram_bucket_factor", 1.1, "Growth factor of the buckets of the native histograms of the latencies sampled by the background polling. Disabled when not greater than 1.")
+		poolSize       = flag.Int("mcrouter.idle_connections", 1+len(collectorFactories), "Number of idle connections to mcrouter kept for reuse across scrapes, one per collector by default. 0 opens new connections on every scrape.")
+		showVersion    = flag.Bool("version", false, "Print version information.")
+		listenAddress  = flag.String("web.listen-address", ":9442", "Address to listen on for web interface and telemetry.")
+		metricsPath    = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+		serverInclude  = flag.String("mcrouter.server_include", "", "Only export per-server metrics for servers matching this regex.")
+		serverExclude  = flag.String("mcrouter.server_exclude", "", "Do not export per-server metrics for servers matching this regex.")
+		serverTopK     = flag.Int("mcrouter.server_topk", 0, "Only export per-server metrics for the K worst servers (0 exports all).")
+		serverTopKBy   = flag.String("mcrouter.server_topk_by", "latency", "Ranking used by -mcrouter.server_topk, one of: latency, errors, tko.")
+		serverOther    = flag.Bool("mcrouter.server_aggregate_other", false, "Aggregate the servers filtered out of the per-server metrics into server=\"other\" instead of dropping them. There is no per-pool aggregation, mcrouter does not report the pool of a server.")
+		options        = flag.String("mcrouter.options", "", "Comma-separated list of startup options to export as info metrics, e.g. num-proxies,server-timeout,route-prefix.")
+		targets        = flag.String("mcrouter.targets", "", "Comma-separated list of mcrouter addresses to scrape instead of -mcrouter.address, labeling series with the target and detecting config drift across them.")
+		k8sSelector    = flag.String("kubernetes.selector", "", "Label selector of the mcrouter pods to discover through the Kubernetes API and scrape instead of -mcrouter.address, e.g. app=mcrouter. Disabled when empty.")
+		k8sNamespace   = flag.String("kubernetes.namespace", "", "Namespace of the mcrouter pods, all namespaces when empty.")
+		k8sPort        = flag.String("kubernetes.port", "5000", "Number or name of the mcrouter container port of the discovered pods.")
+		k8sAPIServer   = flag.String("kubernetes.api-server", "", "Address of the Kubernetes API server, e.g. http://localhost:8001 for kubectl proxy. Uses the in-cluster service account when empty.")
+		fileSDFiles    = flag.String("file_sd.files", "", "Comma-separated list of Prometheus file_sd files (JSON or YAML, globs allowed) listing the mcrouter targets to scrape instead of -mcrouter.address. Disabled when empty.")
+		fileSDPoll     = flag.Duration("file_sd.poll-interval", 5*time.Second, "Interval between two checks of the file_sd files for changes.")
+		dnsSDNames     = flag.String("dns_sd.names", "", "Comma-separated list of DNS names resolving to the mcrouter targets to scrape instead of -mcrouter.address. Disabled when empty.")
+		dnsSDType      = flag.String("dns_sd.type", "SRV", "Type of the records of -dns_sd.names, one of: SRV, A.")
+		dnsSDPort      = flag.Int("dns_sd.port", 5000, "Port of the mcrouter targets resolved from A records.")
+		refresh        = flag.Duration("discovery.refresh-interval", 30*time.Second, "Interval between two discoveries of the mcrouter targets.")
+		readyMaxAge    = flag.Duration("web.ready-max-age", 30*time.Second, "Maximum age of the last mcrouter probe before /-/ready probes mcrouter again.")
+		readyFraction  = flag.Float64("web.ready-min-targets", 0, "Fraction of the mcrouter targets of a fleet that must be ready for /-/ready to succeed, e.g. 0.5. At least one target must always be ready.")
+		pushURL        = flag.String("push.url", "", "Pushgateway or remote-write URL to periodically push metrics to. Disabled when empty.")
+		pushFormat     = flag.String("push.format", "pushgateway", "Protocol used by -push.url, one of: pushgateway, remote-write.")
+		pushInterval   = flag.Duration("push.interval", 15*time.Second, "Interval between two pushes.")
+		pushJob        = flag.String("push.job", "mcrouter", "Job name attached to pushed metrics.")
+		pushRetries    = flag.Int("push.retries", 3, "Number of times a failed push is retried before waiting for the next interval.")
+		otlpEndpoint   = flag.String("otlp.endpoint", "", "OTLP/HTTP metrics endpoint of an OpenTelemetry collector, e.g. http://localhost:4318/v1/metrics. Disabled when empty.")
+		otlpInterval   = flag.Duration("otlp.interval", 15*time.Second, "Interval between two OTLP exports.")
+		statsdAddress  = flag.String("statsd.address", "", "UDP address of a DogStatsD agent to periodically send metrics to, e.g. localhost:8125. Disabled when empty.")
+		statsdInterval = flag.Duration("statsd.interval", 15*time.Second, "Interval between two DogStatsD flushes.")
+		statsdTags     = flag.String("statsd.tags", "", "Comma-separated list of tags (key:value) added to every DogStatsD metric.")
+		logLevel       = flag.String(promlogflag.LevelFlagName, "info", promlogflag.LevelFlagHelp)
+		logFormat      = flag.String(promlogflag.FormatFlagName, "logfmt", promlogflag.FormatFlagHelp)
 	)
+	flag.Usage = usage
+	if runSubcommand(os.Args[1:]) {
+		return
+	}
+	collectorFlags := registerCollectorFlags(flag.CommandLine)
+	// Flags that predate the collectors
+	flag.BoolVar(collectorFlags.enabled["servers"], "mcrouter.server_metrics", false, "Collect per-server metrics, alias of -collector.servers.")
 	flag.Parse()
 
 	if *showVersion {
@@ -816,15 +822,143 @@ func main() {
 	level.Info(logger).Log("msg", "Starting mcrouter_exporter", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
 
-	prometheus.MustRegister(NewExporter(*address, *timeout, *serverMetrics, logger))
-	http.Handle(*metricsPath, promhttp.Handler())
+	var filter *serverFilter
+	if *serverInclude != "" || *serverExclude != "" || *serverTopK > 0 {
+		var err error
+		filter, err = newServerFilter(*serverInclude, *serverExclude, *serverTopK, *serverTopKBy, *serverOther)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid per-server metrics filter", "err", err)
+			os.Exit(1)
+		}
+	}
+	optionList := parseOptionList(*options)
+	newExporter := func(address string) *Exporter {
+		e := NewExporter(address, *timeout, false, logger)
+		collectorFlags.apply(e)
+		e.serverFilter = filter
+		e.readTimeout = *readTimeout
+		e.pool.keepAlive = *keepAlive
+		e.pool.size = *poolSize
+		e.options = optionList
+		if *pollInterval > 0 {
+			e.startPolling(*pollInterval, *tkoHistory, *bucketFactor)
+		}
+		return e
+	}
+
+	// Either scrape a single mcrouter, or a fleet of them labeled by target.
+	var gatherer prometheus.Gatherer
+	metricsHandler := promhttp.Handler()
+	links := `<p><a href='` + *metricsPath + `'>Metrics</a></p>`
+	discoverers := make(map[string]discoverer)
+	if *k8sSelector != "" {
+		d, err := newPodDiscovery(*k8sAPIServer, *k8sNamespace, *k8sSelector, *k8sPort, *refresh)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid Kubernetes discovery configuration", "err", err)
+			os.Exit(1)
+		}
+		discoverers["kubernetes"] = d
+	}
+	if *fileSDFiles != "" {
+		d, err := newFileDiscovery(strings.Split(*fileSDFiles, ","))
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid file discovery configuration", "err", err)
+			os.Exit(1)
+		}
+		discoverers["file"] = d
+	}
+	if *dnsSDNames != "" {
+		d, err := newDNSDiscovery(strings.Split(*dnsSDNames, ","), *dnsSDType, *dnsSDPort)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid DNS discovery configuration", "err", err)
+			os.Exit(1)
+		}
+		discoverers["dns"] = d
+	}
+	isFleet := *targets != "" || len(discoverers) > 0
+	if isFleet {
+		f := newFleet(nil, optionList, newExporter, logger)
+		if *targets != "" {
+			f.updateSource("static", staticTargets(strings.Split(*targets, ",")))
+		}
+		for source, d := range discoverers {
+			interval := *refresh
+			if source == "file" {
+				// Reading the files is cheap when they did not change
+				interval = *fileSDPoll
+			}
+			go runDiscovery(context.Background(), source, d, f, interval, logger)
+		}
+		gatherer = f
+		metricsHandler = promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, f}, promhttp.HandlerOpts{}))
+		http.Handle("/-/ready", f.readyHandler(*readyMaxAge, *readyFraction))
+		http.HandleFunc("/drift", f.driftHandler)
+		links += `
+             <p><a href='/drift'>Config drift</a></p>`
+		if *pollInterval > 0 {
+			http.HandleFunc("/debug/tko", f.tkoHandler)
+		}
+	} else {
+		e := newExporter(*address)
+		prometheus.MustRegister(e)
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(e)
+		gatherer = registry
+		http.Handle("/-/ready", e.readyHandler(*readyMaxAge))
+		if *pollInterval > 0 {
+			http.HandleFunc("/debug/tko", e.tkoHandler)
+		}
+	}
+
+	// The sinks share their gathers, so that mcrouter is not scraped once
+	// per sink. Sinks ticking within half of the shortest interval of each
+	// other push the same metrics.
+	sinkInterval := *pushInterval
+	for _, interval := range []time.Duration{*otlpInterval, *statsdInterval} {
+		if interval < sinkInterval {
+			sinkInterval = interval
+		}
+	}
+	sinkGatherer := newSharedGatherer(gatherer, sinkInterval/2)
+
+	if *pushURL != "" {
+		p, err := newPusher(*pushFormat, *pushURL, *pushJob, *address, isFleet, *pushInterval)
+		if err != nil {
+			level.Error(logger).Log("msg", "Invalid push configuration", "err", err)
+			os.Exit(1)
+		}
+		level.Info(logger).Log("msg", "Pushing metrics", "url", *pushURL, "format", *pushFormat, "interval", *pushInterval)
+		go runPusher(context.Background(), p, sinkGatherer, *pushInterval, *pushRetries, logger)
+	}
+
+	if *otlpEndpoint != "" {
+		level.Info(logger).Log("msg", "Exporting metrics over OTLP", "endpoint", *otlpEndpoint, "interval", *otlpInterval)
+		go runPusher(context.Background(), newOTLPPusher(*otlpEndpoint, *address, isFleet, *otlpInterval, logger), sinkGatherer, *otlpInterval, *pushRetries, logger)
+	}
+
+	if *statsdAddress != "" {
+		var tags []string
+		if *statsdTags != "" {
+			tags = strings.Split(*statsdTags, ",")
+		}
+		level.Info(logger).Log("msg", "Sending metrics to DogStatsD", "address", *statsdAddress, "interval", *statsdInterval)
+		go runPusher(context.Background(), newStatsdPusher(*statsdAddress, tags), sinkGatherer, *statsdInterval, 0, logger)
+	}
+
+	if *pollInterval > 0 {
+		links += `
+             <p><a href='/debug/tko'>TKO transitions</a></p>`
+	}
+	http.Handle(*metricsPath, metricsHandler)
+	http.HandleFunc("/-/healthy", healthyHandler)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		//nolint:errcheck
 		w.Write([]byte(`<html>
              <head><title>Mcrouter Exporter</title></head>
              <body>
              <h1>Mcrouter Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
+             ` + links + `
              </body>
              </html>`))
 	})
@@ -3,8 +3,14 @@ package main
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Dev25/mcrouter_exporter/internal/mcroutertest"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -138,3 +144,68 @@ func TestServerStatsParsingAfterMcrouterBootstrap(t *testing.T) {
 
 	})
 }
+
+// Start a fake mcrouter answering each command with its canned reply
+func serveCommands(t *testing.T, replies map[string]string) *mcroutertest.Server {
+	s, err := mcroutertest.NewServer("127.0.0.1:0", replies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Gather the metrics of a collector as a map of name{labels} to value
+func gatherValues(t *testing.T, c prometheus.Collector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			var labels []string
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, lp.GetName()+"="+strconv.Quote(lp.GetValue()))
+			}
+			key := mf.GetName() + "{" + strings.Join(labels, ",") + "}"
+			switch {
+			case m.Gauge != nil:
+				values[key] = m.GetGauge().GetValue()
+			case m.Counter != nil:
+				values[key] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+func TestServerMetricsCollection(t *testing.T) {
+	Convey("Given a remote mcrouter with per-server stats", t, func() {
+		l := serveCommands(t, map[string]string{
+			"stats all": "STAT version 37.0.0\r\nEND\r\n",
+			"stats servers": "STAT 10.1.1.1:11211:ascii:plain:notcompressed-1000 avg_latency_us:302.991 pending_reqs:0 inflight_reqs:0 " +
+				"avg_retrans_ratio:0.5 max_retrans_ratio:2 min_retrans_ratio:0.1 up:3 down:1 hard_tko; found:10\r\nEND\r\n",
+		})
+		defer l.Close()
+
+		Convey("When scraped with per-server metrics enabled", func() {
+			values := gatherValues(t, NewExporter(l.Addr(), time.Second, true, log.NewNopLogger()))
+			server := `server="10.1.1.1:11211:ascii:plain:notcompressed-1000"`
+
+			Convey("It should export the retransmission ratios", func() {
+				So(values[`mcrouter_server_retrans_ratio{`+server+`,stat="avg"}`], ShouldEqual, 0.5)
+				So(values[`mcrouter_server_retrans_ratio{`+server+`,stat="min"}`], ShouldEqual, 0.1)
+				So(values[`mcrouter_server_retrans_ratio{`+server+`,stat="max"}`], ShouldEqual, 2)
+			})
+
+			Convey("It should export the connection states", func() {
+				So(values[`mcrouter_server_connections{`+server+`,state="up"}`], ShouldEqual, 3)
+				So(values[`mcrouter_server_connections{`+server+`,state="down"}`], ShouldEqual, 1)
+				So(values, ShouldContainKey, `mcrouter_server_connections{`+server+`,state="closed"}`)
+				So(values[`mcrouter_server_memcached_hard_tko{`+server+`}`], ShouldEqual, 1)
+			})
+		})
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	optionInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "option_info"),
+		"Startup option of mcrouter, from its command line or __mcrouter__.options.",
+		[]string{"option", "value"},
+		nil,
+	)
+	optionDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "option"),
+		"Value of a numeric startup option of mcrouter.",
+		[]string{"option"},
+		nil,
+	)
+)
+
+// normalizeOption turns an option name as found on the command line
+// (--num-proxies) or in __mcrouter__.options (num_proxies) into a common
+// form (num-proxies).
+func normalizeOption(name string) string {
+	return strings.ReplaceAll(strings.TrimLeft(name, "-"), "_", "-")
+}
+
+// parseOptionList parses the comma-separated list of -mcrouter.options into
+// normalized option names, without blanks nor duplicates which would export
+// the same series twice.
+func parseOptionList(list string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = normalizeOption(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// parseCommandArgs parses the mcrouter command line reported by the
+// commandargs stat into options. Both --name=value and --name value forms
+// are supported; flags without a value are reported as "true".
+func parseCommandArgs(args string) map[string]string {
+	options := make(map[string]string)
+	fields := strings.Fields(args)
+	for i := 0; i < len(fields); i++ {
+		if !strings.HasPrefix(fields[i], "-") {
+			continue
+		}
+		if nameValue := strings.SplitN(fields[i], "=", 2); len(nameValue) == 2 {
+			options[normalizeOption(nameValue[0])] = nameValue[1]
+			continue
+		}
+		name := normalizeOption(fields[i])
+		if i+1 < len(fields) && !strings.HasPrefix(fields[i+1], "-") {
+			options[name] = fields[i+1]
+			i++
+		} else {
+			options[name] = "true"
+		}
+	}
+	return options
+}
+
+// Get a service info value (e.g. __mcrouter__.options) from mcrouter using
+// the get command. The boolean result is false when mcrouter does not know
+// the key.
+func getServiceInfo(conn net.Conn, key string) (string, bool, error) {
+	c := newMcrouterConn(conn)
+	if err := c.send("get " + key); err != nil {
+		return "", false, err
+	}
+	return readServiceInfo(c.reader, key)
+}
+
+// Read the reply to the get command of a service info value, e.g.
+//
+//	VALUE __mcrouter__.config_md5_digest 0 32
+//	0123456789abcdef0123456789abcdef
+//	END
+func readServiceInfo(reader *bufio.Reader, key string) (string, bool, error) {
+	command := "get " + key
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", false, &truncatedError{command: command, err: err}
+	}
+	if line == "END\r\n" {
+		return "", false, nil
+	}
+
+	header := strings.Fields(line)
+	if len(header) < 4 || header[0] != "VALUE" {
+		return "", false, &malformedLineError{command: command, line: strings.TrimRight(line, "\r\n")}
+	}
+	size, err := strconv.Atoi(header[3])
+	if err != nil || size < 0 {
+		return "", false, &malformedLineError{command: command, line: strings.TrimRight(line, "\r\n")}
+	}
+
+	// The value is followed by \r\n and the END line
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", false, &truncatedError{command: command, err: err}
+	}
+	if line, err = reader.ReadString('\n'); err != nil {
+		return "", false, &truncatedError{command: command, err: err}
+	}
+	if line != "END\r\n" {
+		return "", false, &malformedLineError{command: command, line: strings.TrimRight(line, "\r\n")}
+	}
+	return string(data[:size]), true, nil
+}
+
+// Get the startup options from mcrouter, as reported by __mcrouter__.options
+func getOptions(conn net.Conn) (map[string]string, error) {
+	value, _, err := getServiceInfo(conn, "__mcrouter__.options")
+	if err != nil {
+		return nil, err
+	}
+	return parseOptions(value), nil
+}
+
+// Parse the value of __mcrouter__.options, with one "name value" pair per
+// line
+func parseOptions(value string) map[string]string {
+	options := make(map[string]string)
+	for _, line := range strings.Split(value, "\n") {
+		nameValue := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(nameValue) != 2 {
+			continue
+		}
+		options[normalizeOption(nameValue[0])] = strings.TrimSpace(nameValue[1])
+	}
+	return options
+}
+
+// startupOptions returns the startup options of mcrouter, preferring the
+// values of __mcrouter__.options (which include defaults) over the command
+// line.
+func startupOptions(stats map[string]string, serviceOptions map[string]string) map[string]string {
+	options := parseCommandArgs(stats["commandargs"])
+	for name, value := range serviceOptions {
+		options[name] = value
+	}
+	return options
+}
+
+func init() {
+	registerCollector("config", true, "Collect the startup options listed in -mcrouter.options, and the config digest of fleet targets.", func(e *Exporter) collector {
+		if len(e.options) == 0 && !e.trackInfo {
+			return nil
+		}
+		return &configCollector{e: e}
+	})
+}
+
+// configCollector delivers the allowlisted startup options, and remembers
+// the configuration of mcrouter for drift detection across a fleet.
+type configCollector struct {
+	e *Exporter
+}
+
+func (c *configCollector) describe(ch chan<- *prometheus.Desc) {
+	if len(c.e.options) > 0 {
+		ch <- optionInfoDesc
+		ch <- optionDesc
+	}
+}
+
+func (c *configCollector) commands() []string {
+	commands := []string{"get __mcrouter__.options"}
+	if c.e.trackInfo {
+		commands = append(commands, "get __mcrouter__.config_md5_digest")
+	}
+	return commands
+}
+
+func (c *configCollector) update(reader *bufio.Reader, stats map[string]string, ch chan<- prometheus.Metric) error {
+	value, _, err := readServiceInfo(reader, "__mcrouter__.options")
+	if !reusable(err) {
+		return err
+	}
+	// Older mcrouters without __mcrouter__.options only report the command line
+	if err != nil {
+		level.Warn(c.e.logger).Log("msg", "Failed to get options from mcrouter, falling back to its command line", "err", err)
+	}
+	options := startupOptions(stats, parseOptions(value))
+
+	if c.e.trackInfo {
+		configMD5, _, err := readServiceInfo(reader, "__mcrouter__.config_md5_digest")
+		if err != nil {
+			return err
+		}
+		c.e.recordInfo(stats, configMD5, options)
+	}
+
+	for _, name := range c.e.options {
+		value, ok := options[name]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(optionInfoDesc, prometheus.GaugeValue, 1, name, value)
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			ch <- prometheus.MustNewConstMetric(optionDesc, prometheus.GaugeValue, v, name)
+		}
+	}
+	return nil
+}
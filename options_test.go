@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCommandArgsParsing(t *testing.T) {
+	Convey("Given a mcrouter command line", t, func() {
+		args := "--config-file=/etc/mcrouter.json -p 5000 --num-proxies 4 --test-mode --route-prefix /a/b/"
+
+		Convey("It should parse it into normalized options", func() {
+			So(parseCommandArgs(args), ShouldResemble, map[string]string{
+				"config-file":  "/etc/mcrouter.json",
+				"p":            "5000",
+				"num-proxies":  "4",
+				"test-mode":    "true",
+				"route-prefix": "/a/b/",
+			})
+		})
+	})
+}
+
+func TestServiceInfoParsing(t *testing.T) {
+	Convey("Given a remote mcrouter service info endpoint", t, func() {
+		server, client := net.Pipe()
+		go func() {
+			buf := make([]byte, 1024)
+			server.Read(buf)
+			server.Write([]byte("VALUE __mcrouter__.options 0 33\r\nnum_proxies 2\nserver_timeout 1000\r\nEND\r\n"))
+			server.Close()
+		}()
+
+		Convey("It should parse the options", func() {
+			options, err := getOptions(client)
+			So(err, ShouldBeNil)
+			So(options, ShouldResemble, map[string]string{"num-proxies": "2", "server-timeout": "1000"})
+		})
+	})
+
+	Convey("Given a remote mcrouter without the requested service info", t, func() {
+		server, client := net.Pipe()
+		go func() {
+			buf := make([]byte, 1024)
+			server.Read(buf)
+			server.Write([]byte("END\r\n"))
+			server.Close()
+		}()
+
+		Convey("It should report the key as missing", func() {
+			_, ok, err := getServiceInfo(client, "__mcrouter__.options")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
+
+func TestOptionsCollection(t *testing.T) {
+	Convey("Given a remote mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{
+			"stats all":                "STAT commandargs --num-proxies 4 --route-prefix /a/b/ --server-timeout 500\r\nEND\r\n",
+			"get __mcrouter__.options": "VALUE __mcrouter__.options 0 19\r\nserver_timeout 1000\r\nEND\r\n",
+		})
+		defer l.Close()
+
+		Convey("When scraped with an options allowlist", func() {
+			e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+			e.options = parseOptionList("num-proxies, server_timeout,route-prefix,big-value-split-threshold,num_proxies,")
+			values := gatherValues(t, e)
+
+			Convey("It should export the allowlisted options", func() {
+				So(values[`mcrouter_option_info{option="num-proxies",value="4"}`], ShouldEqual, 1)
+				So(values[`mcrouter_option_info{option="route-prefix",value="/a/b/"}`], ShouldEqual, 1)
+				So(values[`mcrouter_option_info{option="server-timeout",value="1000"}`], ShouldEqual, 1)
+				So(values[`mcrouter_option{option="num-proxies"}`], ShouldEqual, 4)
+				So(values[`mcrouter_option{option="server-timeout"}`], ShouldEqual, 1000)
+				So(values, ShouldNotContainKey, `mcrouter_option{option="route-prefix"}`)
+			})
+
+			Convey("It should export each option once, however it is spelled", func() {
+				So(e.options, ShouldResemble, []string{"num-proxies", "server-timeout", "route-prefix", "big-value-split-threshold"})
+			})
+		})
+	})
+}
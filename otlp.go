@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLP AggregationTemporality value for cumulative sums, see
+// opentelemetry/proto/metrics/v1/metrics.proto.
+const otlpTemporalityCumulative = 2
+
+// otlpPusher exports metrics to an OpenTelemetry collector using OTLP/HTTP
+// with protobuf encoding. Counters become cumulative monotonic sums, gauges
+// stay gauges and native histograms become exponential histograms. The
+// resource carries the mcrouter version and a hash of its command line, and
+// in a fleet each target is exported as its own resource.
+type otlpPusher struct {
+	endpoint  string
+	instance  string
+	perTarget bool
+	client    *http.Client
+	logger    log.Logger
+
+	// Metrics that cannot be converted, logged once.
+	mu      sync.Mutex
+	skipped map[string]bool
+}
+
+func newOTLPPusher(endpoint, instance string, perTarget bool, timeout time.Duration, logger log.Logger) *otlpPusher {
+	return &otlpPusher{
+		endpoint:  endpoint,
+		instance:  instance,
+		perTarget: perTarget,
+		client:    &http.Client{Timeout: timeout},
+		logger:    logger,
+		skipped:   make(map[string]bool),
+	}
+}
+
+func (p *otlpPusher) push(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	// Concatenated requests are merged into one by the decoder, with a
+	// resource per instance.
+	var body []byte
+	now := time.Now()
+	groups := groupByInstance(mfs, p.instance, p.perTarget)
+	for _, instance := range sortedInstances(groups) {
+		request, skipped := encodeOTLPMetrics(groups[instance], instance, now)
+		body = append(body, request...)
+		p.logSkipped(skipped)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status code %d while exporting to %s: %s", resp.StatusCode, p.endpoint, msg)
+	}
+	return nil
+}
+
+// logSkipped warns about the metrics that could not be converted, the first
+// time they are seen.
+func (p *otlpPusher) logSkipped(names []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, name := range names {
+		if !p.skipped[name] {
+			p.skipped[name] = true
+			level.Warn(p.logger).Log("msg", "Metric type not supported over OTLP, skipping it", "metric", name)
+		}
+	}
+}
+
+// encodeOTLPMetrics encodes the metric families of a mcrouter as an OTLP
+// ExportMetricsServiceRequest protobuf message, with a resource describing
+// it, and returns the names of the families that could not be converted.
+// In a fleet, the metrics of each target are encoded separately.
+func encodeOTLPMetrics(mfs []*dto.MetricFamily, instance string, now time.Time) ([]byte, []string) {
+	attrs := map[string]string{
+		"service.name":        "mcrouter",
+		"service.instance.id": instance,
+	}
+	var startTime uint64
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			switch mf.GetName() {
+			case namespace + "_version":
+				attrs["mcrouter.version"] = labelValue(m, "version")
+			case namespace + "_commandargs":
+				sum := sha256.Sum256([]byte(labelValue(m, "commandargs")))
+				attrs["mcrouter.commandargs.hash"] = hex.EncodeToString(sum[:8])
+			case namespace + "_start_time_seconds":
+				startTime = uint64(m.GetCounter().GetValue() * 1e9)
+			}
+		}
+	}
+	var resource []byte
+	for _, k := range sortedKeys(attrs) {
+		resource = appendMessage(resource, 1, encodeOTLPKeyValue(k, attrs[k]))
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "mcrouter_exporter")
+	scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+	scope = protowire.AppendString(scope, version.Version)
+
+	var skipped []string
+	var scopeMetrics []byte
+	scopeMetrics = appendMessage(scopeMetrics, 1, scope)
+	for _, mf := range mfs {
+		if metric := encodeOTLPMetric(mf, startTime, uint64(now.UnixNano())); metric != nil {
+			scopeMetrics = appendMessage(scopeMetrics, 2, metric)
+		} else {
+			skipped = append(skipped, mf.GetName())
+		}
+	}
+
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, 1, resource)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeMetrics)
+
+	return appendMessage(nil, 1, resourceMetrics), skipped
+}
+
+// encodeOTLPMetric encodes a metric family as an OTLP Metric message. Only
+// counters, gauges and native histograms are converted, nil is returned for
+// other types. Counters start at startTime, in nanoseconds, when known.
+func encodeOTLPMetric(mf *dto.MetricFamily, startTime, now uint64) []byte {
+	var points []byte
+	for _, m := range mf.GetMetric() {
+		// Attributes of the point, field 7 of NumberDataPoint and field 1 of
+		// ExponentialHistogramDataPoint.
+		attrs := func(point []byte, num protowire.Number) []byte {
+			for _, lp := range m.GetLabel() {
+				point = appendMessage(point, num, encodeOTLPKeyValue(lp.GetName(), lp.GetValue()))
+			}
+			return point
+		}
+
+		var value float64
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			value = m.GetCounter().GetValue()
+		case dto.MetricType_GAUGE:
+			value = m.GetGauge().GetValue()
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			if h.Schema == nil {
+				// Classic histogram
+				return nil
+			}
+			points = appendMessage(points, 1, encodeOTLPExponentialPoint(attrs(nil, 1), h, now))
+			continue
+		default:
+			return nil
+		}
+
+		var point []byte
+		if mf.GetType() == dto.MetricType_COUNTER && startTime > 0 {
+			point = protowire.AppendTag(point, 2, protowire.Fixed64Type)
+			point = protowire.AppendFixed64(point, startTime)
+		}
+		point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, now)
+		point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, math.Float64bits(value))
+		points = appendMessage(points, 1, attrs(point, 7))
+	}
+
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, mf.GetName())
+	metric = protowire.AppendTag(metric, 2, protowire.BytesType)
+	metric = protowire.AppendString(metric, mf.GetHelp())
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		points = protowire.AppendTag(points, 2, protowire.VarintType)
+		points = protowire.AppendVarint(points, otlpTemporalityCumulative)
+		points = protowire.AppendTag(points, 3, protowire.VarintType)
+		points = protowire.AppendVarint(points, 1)
+		metric = appendMessage(metric, 7, points)
+	case dto.MetricType_HISTOGRAM:
+		points = protowire.AppendTag(points, 2, protowire.VarintType)
+		points = protowire.AppendVarint(points, otlpTemporalityCumulative)
+		metric = appendMessage(metric, 10, points)
+	default:
+		metric = appendMessage(metric, 5, points)
+	}
+	return metric
+}
+
+// encodeOTLPExponentialPoint encodes a native histogram as an OTLP
+// ExponentialHistogramDataPoint, whose scale is the schema of the histogram.
+func encodeOTLPExponentialPoint(point []byte, h *dto.Histogram, now uint64) []byte {
+	point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, now)
+	point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, h.GetSampleCount())
+	point = protowire.AppendTag(point, 5, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, math.Float64bits(h.GetSampleSum()))
+	point = protowire.AppendTag(point, 6, protowire.VarintType)
+	point = protowire.AppendVarint(point, protowire.EncodeZigZag(int64(h.GetSchema())))
+	point = protowire.AppendTag(point, 7, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, h.GetZeroCount())
+	if buckets := encodeOTLPBuckets(h.GetPositiveSpan(), h.GetPositiveDelta()); buckets != nil {
+		point = appendMessage(point, 8, buckets)
+	}
+	if buckets := encodeOTLPBuckets(h.GetNegativeSpan(), h.GetNegativeDelta()); buckets != nil {
+		point = appendMessage(point, 9, buckets)
+	}
+	point = protowire.AppendTag(point, 14, protowire.Fixed64Type)
+	return protowire.AppendFixed64(point, math.Float64bits(h.GetZeroThreshold()))
+}
+
+// encodeOTLPBuckets converts the spans and delta-encoded counts of native
+// histogram buckets into dense OTLP Buckets. Bucket i of Prometheus covers
+// (base^(i-1), base^i] and bucket i of OTLP (base^i, base^(i+1)], hence the
+// offset shifted by one.
+func encodeOTLPBuckets(spans []*dto.BucketSpan, deltas []int64) []byte {
+	if len(spans) == 0 {
+		return nil
+	}
+	var (
+		first, index int32
+		count        int64
+		counts       []byte
+		n            int32
+	)
+	for i, span := range spans {
+		index += span.GetOffset()
+		if i == 0 {
+			first = index
+		}
+		// Empty buckets between spans
+		for ; first+n < index; n++ {
+			counts = protowire.AppendVarint(counts, 0)
+		}
+		for j := uint32(0); j < span.GetLength() && len(deltas) > 0; j++ {
+			count += deltas[0]
+			deltas = deltas[1:]
+			counts = protowire.AppendVarint(counts, uint64(count))
+			index++
+			n++
+		}
+	}
+
+	var buckets []byte
+	buckets = protowire.AppendTag(buckets, 1, protowire.VarintType)
+	buckets = protowire.AppendVarint(buckets, protowire.EncodeZigZag(int64(first-1)))
+	buckets = protowire.AppendTag(buckets, 2, protowire.BytesType)
+	return protowire.AppendBytes(buckets, counts)
+}
+
+// encodeOTLPKeyValue encodes a KeyValue message holding a string value.
+func encodeOTLPKeyValue(key, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	return appendMessage(kv, 2, anyValue)
+}
+
+// appendMessage appends an embedded message field to b.
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+// labelValue returns the value of the named label of m.
+func labelValue(m *dto.Metric, name string) string {
+	for _, lp := range m.GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+// sortedKeys returns the keys of m in lexical order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
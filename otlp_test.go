@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpPoint is a data point decoded from an OTLP request
+type otlpPoint struct {
+	attrs map[string]string
+	// Numbers of the fixed64 and varint fields
+	fields map[protowire.Number]uint64
+	// Positive buckets of exponential histograms
+	offset int64
+	counts []uint64
+}
+
+// otlpRequest is an OTLP request decoded for the tests
+type otlpRequest struct {
+	resource map[string]string
+	// Kind of the metrics by name, the number of their data field
+	kinds  map[string]protowire.Number
+	points map[string][]otlpPoint
+}
+
+// Decode a list of KeyValue messages with string values
+func decodeOTLPAttribute(t *testing.T, kv []byte, attrs map[string]string) {
+	var key, value string
+	walkProto(t, kv, func(num protowire.Number, v []byte, _ uint64) {
+		if num == 1 {
+			key = string(v)
+		} else {
+			walkProto(t, v, func(_ protowire.Number, s []byte, _ uint64) { value = string(s) })
+		}
+	})
+	attrs[key] = value
+}
+
+func decodeOTLPMetrics(t *testing.T, b []byte) *otlpRequest {
+	r := &otlpRequest{
+		resource: map[string]string{},
+		kinds:    map[string]protowire.Number{},
+		points:   map[string][]otlpPoint{},
+	}
+	walkProto(t, b, func(_ protowire.Number, rm []byte, _ uint64) {
+		walkProto(t, rm, func(num protowire.Number, v []byte, _ uint64) {
+			if num == 1 {
+				walkProto(t, v, func(_ protowire.Number, kv []byte, _ uint64) { decodeOTLPAttribute(t, kv, r.resource) })
+				return
+			}
+			walkProto(t, v, func(num protowire.Number, metric []byte, _ uint64) {
+				if num != 2 {
+					return
+				}
+				var name string
+				walkProto(t, metric, func(num protowire.Number, v []byte, _ uint64) {
+					switch num {
+					case 1:
+						name = string(v)
+					case 5, 7, 10:
+						kind := num
+						r.kinds[name] = kind
+						walkProto(t, v, func(num protowire.Number, v []byte, _ uint64) {
+							if num != 1 {
+								return
+							}
+							point := otlpPoint{attrs: map[string]string{}, fields: map[protowire.Number]uint64{}}
+							walkProto(t, v, func(field protowire.Number, v []byte, u uint64) {
+								switch {
+								case field == 1 && kind == 10, field == 7 && kind != 10:
+									decodeOTLPAttribute(t, v, point.attrs)
+								case field == 8 && kind == 10:
+									walkProto(t, v, func(field protowire.Number, v []byte, u uint64) {
+										if field == 1 {
+											point.offset = protowire.DecodeZigZag(u)
+											return
+										}
+										for len(v) > 0 {
+											count, n := protowire.ConsumeVarint(v)
+											point.counts = append(point.counts, count)
+											v = v[n:]
+										}
+									})
+								default:
+									point.fields[field] = u
+								}
+							})
+							r.points[name] = append(r.points[name], point)
+						})
+					}
+				})
+			})
+		})
+	})
+	return r
+}
+
+func TestOTLPEncoding(t *testing.T) {
+	Convey("Given an exporter scraping mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{"stats all": "STAT start_time 1600000000\r\nSTAT version 37.0.0\r\nSTAT commandargs -p 5000\r\nSTAT cmd_get_count 42\r\nEND\r\n"})
+		defer l.Close()
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(NewExporter(l.Addr(), time.Second, false, log.NewNopLogger()))
+		mfs, err := registry.Gather()
+		So(err, ShouldBeNil)
+
+		Convey("When encoded as an OTLP request", func() {
+			b, skipped := encodeOTLPMetrics(mfs, l.Addr(), time.Unix(1700000000, 0))
+			So(skipped, ShouldBeEmpty)
+			r := decodeOTLPMetrics(t, b)
+
+			Convey("It should describe mcrouter in the resource attributes", func() {
+				So(r.resource["service.instance.id"], ShouldEqual, l.Addr())
+				So(r.resource["mcrouter.version"], ShouldEqual, "37.0.0")
+				So(r.resource["mcrouter.commandargs.hash"], ShouldHaveLength, 16)
+			})
+
+			Convey("It should keep the metric labels alone on the data points", func() {
+				point := r.points["mcrouter_command_count"][0]
+				So(point.attrs, ShouldContainKey, "cmd")
+				So(point.attrs, ShouldNotContainKey, "mcrouter.version")
+				So(point.attrs, ShouldNotContainKey, "mcrouter.commandargs.hash")
+			})
+
+			Convey("It should convert counters to sums and gauges to gauges", func() {
+				So(r.kinds["mcrouter_command_count"], ShouldEqual, 7)
+				So(r.kinds["mcrouter_up"], ShouldEqual, 5)
+				So(r.points["mcrouter_command_count"][0].fields[2], ShouldEqual, uint64(1600000000)*1e9)
+			})
+		})
+	})
+
+	Convey("Given the metrics of a fleet of two mcrouters", t, func() {
+		family := func(name string, typ dto.MetricType, metrics ...*dto.Metric) *dto.MetricFamily {
+			return &dto.MetricFamily{Name: proto.String(name), Help: proto.String(name), Type: typ.Enum(), Metric: metrics}
+		}
+		metric := func(target string, value float64, labels ...string) *dto.Metric {
+			m := &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(value)}, Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+			labels = append(labels, "target", target)
+			for i := 0; i < len(labels); i += 2 {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+			}
+			return m
+		}
+		mfs := []*dto.MetricFamily{
+			family("mcrouter_start_time_seconds", dto.MetricType_COUNTER, metric("a", 1600000000), metric("b", 1650000000)),
+			family("mcrouter_version", dto.MetricType_GAUGE, metric("a", 1, "version", "37.0.0"), metric("b", 1, "version", "38.0.0")),
+			family("mcrouter_command_count", dto.MetricType_COUNTER, metric("a", 1), metric("b", 2)),
+			family("mcrouter_classic_seconds", dto.MetricType_HISTOGRAM, &dto.Metric{Histogram: &dto.Histogram{SampleCount: proto.Uint64(1)}}),
+		}
+
+		Convey("Each target should be exported as its own resource, with its version and start time", func() {
+			var body []byte
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer receiver.Close()
+			p := newOTLPPusher(receiver.URL, "localhost:5000", true, time.Second, log.NewNopLogger())
+			So(p.push(context.Background(), prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })), ShouldBeNil)
+
+			var resources []*otlpRequest
+			walkProto(t, body, func(_ protowire.Number, rm []byte, _ uint64) {
+				resources = append(resources, decodeOTLPMetrics(t, appendMessage(nil, 1, rm)))
+			})
+			// The classic histogram has no target and is kept on the exporter
+			So(resources, ShouldHaveLength, 3)
+			for i, expected := range []struct {
+				instance, version string
+				start             uint64
+			}{
+				{"a", "37.0.0", 1600000000},
+				{"b", "38.0.0", 1650000000},
+			} {
+				So(resources[i].resource["service.instance.id"], ShouldEqual, expected.instance)
+				So(resources[i].resource["mcrouter.version"], ShouldEqual, expected.version)
+				So(resources[i].points["mcrouter_command_count"], ShouldHaveLength, 1)
+				So(resources[i].points["mcrouter_command_count"][0].fields[2], ShouldEqual, expected.start*1e9)
+			}
+			So(resources[2].resource["service.instance.id"], ShouldEqual, "localhost:5000")
+			So(p.skipped, ShouldContainKey, "mcrouter_classic_seconds")
+		})
+
+		Convey("Classic histograms should be reported as skipped", func() {
+			b, skipped := encodeOTLPMetrics(mfs, "exporter:9442", time.Unix(1700000000, 0))
+			So(skipped, ShouldResemble, []string{"mcrouter_classic_seconds"})
+			So(decodeOTLPMetrics(t, b).kinds, ShouldNotContainKey, "mcrouter_classic_seconds")
+		})
+	})
+
+	Convey("Given sampled latencies", t, func() {
+		s := newLatencySampler(1.1, false, nil)
+		for _, us := range []string{"1000", "1000", "1500", "4000"} {
+			s.observe(map[string]string{"duration_us": us}, nil)
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(sampledCollector{s})
+		mfs, err := registry.Gather()
+		So(err, ShouldBeNil)
+		h := mfs[0].GetMetric()[0].GetHistogram()
+
+		Convey("The native histogram should be encoded as an exponential histogram", func() {
+			b, skipped := encodeOTLPMetrics(mfs, "exporter:9442", time.Unix(1700000000, 0))
+			So(skipped, ShouldBeEmpty)
+			r := decodeOTLPMetrics(t, b)
+			So(r.kinds[namespace+"_duration_sample_seconds"], ShouldEqual, 10)
+			point := r.points[namespace+"_duration_sample_seconds"][0]
+			So(point.fields[4], ShouldEqual, 4)
+			So(protowire.DecodeZigZag(point.fields[6]), ShouldEqual, h.GetSchema())
+
+			// Buckets are shifted by one between Prometheus and OTLP, and the
+			// empty buckets between spans are filled in.
+			So(point.offset, ShouldEqual, h.GetPositiveSpan()[0].GetOffset()-1)
+			var total uint64
+			for _, count := range point.counts {
+				total += count
+			}
+			So(total, ShouldEqual, 4)
+			So(point.counts[0], ShouldEqual, 2)
+			So(point.counts[len(point.counts)-1], ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// malformedLineError is returned when a line of a stats reply cannot be
+// parsed.
+type malformedLineError struct {
+	command string
+	line    string
+}
+
+func (e *malformedLineError) Error() string {
+	return fmt.Sprintf("malformed line in reply to %s: %q", e.command, e.line)
+}
+
+// replyError is returned when mcrouter answers a command with ERROR,
+// CLIENT_ERROR or SERVER_ERROR, e.g. for a stats group it does not support.
+type replyError struct {
+	command string
+	reply   string
+}
+
+func (e *replyError) Error() string {
+	return fmt.Sprintf("mcrouter replied to %s with %q", e.command, e.reply)
+}
+
+// truncatedError is returned when the reply to a command ends before its END
+// line, usually because the connection was closed or timed out.
+type truncatedError struct {
+	command string
+	err     error
+}
+
+func (e *truncatedError) Error() string {
+	return fmt.Sprintf("truncated reply to %s: %v", e.command, e.err)
+}
+
+func (e *truncatedError) Unwrap() error {
+	return e.err
+}
+
+// statsReader tokenizes the reply to a stats command line by line, without
+// allocating for lines that fit in the buffer of the underlying reader.
+type statsReader struct {
+	reader  *bufio.Reader
+	command string
+	// Holds the lines longer than the buffer of reader
+	long []byte
+}
+
+func newStatsReader(reader *bufio.Reader, command string) *statsReader {
+	return &statsReader{reader: reader, command: command}
+}
+
+// readLine returns the next line without its \r\n terminator. The line is
+// only valid until the next call.
+func (s *statsReader) readLine() ([]byte, error) {
+	line, err := s.reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		s.long = append(s.long[:0], line...)
+		for errors.Is(err, bufio.ErrBufferFull) {
+			line, err = s.reader.ReadSlice('\n')
+			s.long = append(s.long, line...)
+		}
+		line = s.long
+	}
+	if err != nil {
+		return nil, &truncatedError{command: s.command, err: err}
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// next returns the rest of the next STAT line, after "STAT ", or nil at the
+// END line.
+func (s *statsReader) next() ([]byte, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(line, []byte("STAT ")):
+		return line[len("STAT "):], nil
+	case string(line) == "END":
+		return nil, nil
+	case bytes.HasPrefix(line, []byte("ERROR")),
+		bytes.HasPrefix(line, []byte("CLIENT_ERROR")),
+		bytes.HasPrefix(line, []byte("SERVER_ERROR")):
+		return nil, &replyError{command: s.command, reply: string(line)}
+	}
+	return nil, s.malformed(line)
+}
+
+func (s *statsReader) malformed(line []byte) error {
+	return &malformedLineError{command: s.command, line: string(line)}
+}
+
+// parseStats parses the reply to a stats command into stat values, e.g.
+//
+//	STAT version 37.0.0
+//	STAT commandargs --option1 value --flag2
+//	END
+func parseStats(reader *bufio.Reader, command string) (map[string]string, error) {
+	s := newStatsReader(reader, command)
+	m := make(map[string]string)
+	for {
+		stat, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		if stat == nil {
+			return m, nil
+		}
+
+		// Anything after the stat name is the value
+		i := bytes.IndexByte(stat, ' ')
+		if i <= 0 {
+			return nil, s.malformed(stat)
+		}
+		line := string(stat)
+		m[line[:i]] = line[i+1:]
+	}
+}
+
+// See carbon_result.thrift in mcrouter's codebase
+// and also https://github.com/facebook/mcrouter/wiki/Error-Handling
+var memcachedStates = []string{"deleted", "touched", "found", "notfound", "notstored", "stored",
+	"exists", "timeout", "connect_timeout", "remote_error",
+}
+
+const (
+	softTKOState = "soft_tko"
+	hardTKOState = "hard_tko"
+)
+
+// parseServerStats parses the reply to stats servers into the stats of each
+// destination, e.g.
+//
+//	STAT 10.64.16.110:11211:ascii:plain:notcompressed-1000 avg_latency_us:302.991
+//	     pending_reqs:0 inflight_reqs:0 avg_retrans_ratio:0 max_retrans_ratio:0
+//	     min_retrans_ratio:0 up:5; deleted:4875 touched:33069 found:112675373
+//	     notfound:3493823 notstored:149776 stored:3250883 exists:2653 remote_error:32
+//	END
+//
+// In the same line there are two type of info:
+//   - per-server stats about latency, requests, etc.. up to the ';' - (ProxyDestinationBase states)
+//   - per-server breakdown of the memcached responses (STORED, DELETED, etc..) - (Carbon results)
+//     The memcached responses are listed in carbon_result.thrift, and they are returned/appended only
+//     when > 0. They are set to zero when not displayed, since Prometheus doesn't really like metrics
+//     appearing/disappearing.
+//
+// 'soft_tko' and 'hard_tko' are server flags that appear only when a server
+// is marked with that state. To keep a stable metric, they are reported as 0
+// and turned to 1 only when the flag is found.
+func parseServerStats(reader *bufio.Reader, command string) (map[string]map[string]string, error) {
+	s := newStatsReader(reader, command)
+	m := make(map[string]map[string]string)
+	for {
+		stat, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		if stat == nil {
+			return m, nil
+		}
+
+		// A single string per line, the server id and stats share its memory
+		line := string(stat)
+		serverID, metrics, _ := strings.Cut(line, " ")
+		if serverID == "" || strings.Contains(serverID, ";") {
+			return nil, s.malformed(stat)
+		}
+
+		server := make(map[string]string, 14+len(memcachedStates))
+		server[softTKOState] = "0"
+		server[hardTKOState] = "0"
+		for _, state := range memcachedStates {
+			server[state] = "0"
+		}
+
+		// The memcached's result states (from ';' onward) are not available
+		// when no request was processed yet.
+		for metrics != "" {
+			field := metrics
+			if i := strings.IndexAny(metrics, " ;"); i >= 0 {
+				field, metrics = metrics[:i], metrics[i+1:]
+			} else {
+				metrics = ""
+			}
+			if field == softTKOState || field == hardTKOState {
+				server[field] = "1"
+			} else if name, value, ok := strings.Cut(field, ":"); ok {
+				server[name] = value
+			}
+		}
+		m[serverID] = server
+	}
+}
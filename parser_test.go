@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Dev25/mcrouter_exporter/internal/mcroutertest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// replyConn is an in-memory connection answering any command with a fixed
+// reply, for benchmarking and fuzzing the parsers without a network.
+type replyConn struct {
+	net.Conn
+	reply *bytes.Reader
+}
+
+func newReplyConn(reply []byte) *replyConn {
+	return &replyConn{reply: bytes.NewReader(reply)}
+}
+
+func (c *replyConn) Read(b []byte) (int, error)  { return c.reply.Read(b) }
+func (c *replyConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// Build the reply of stats servers for n destinations, as sent by a large
+// mcrouter deployment
+func serverStatsReply(n int) []byte {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "STAT 10.%d.%d.%d:11211:ascii:plain:notcompressed-1000 avg_latency_us:302.991 pending_reqs:0 inflight_reqs:2 "+
+			"avg_retrans_ratio:0.01 max_retrans_ratio:0.2 min_retrans_ratio:0 up:5 new:1; deleted:4875 touched:33069 "+
+			"found:112675373 notfound:3493823 notstored:149776 stored:3250883 exists:2653 remote_error:32\r\n", i>>16, (i>>8)&0xff, i&0xff)
+	}
+	b.WriteString("END\r\n")
+	return []byte(b.String())
+}
+
+func BenchmarkServerStats(b *testing.B) {
+	reply := serverStatsReply(5000)
+	b.SetBytes(int64(len(reply)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getServerStats(newReplyConn(reply)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParserErrors(t *testing.T) {
+	Convey("Given malformed stats replies", t, func() {
+		cases := []struct {
+			reply  string
+			target interface{}
+		}{
+			{"STAT version\r\nEND\r\n", new(*malformedLineError)},
+			{"STAT\r\nEND\r\n", new(*malformedLineError)},
+			{"\x00\xffnot mcrouter\r\n", new(*malformedLineError)},
+			{"ERROR\r\n", new(*replyError)},
+			{"SERVER_ERROR out of memory\r\n", new(*replyError)},
+			{"STAT version 37.0.0\r\nSTAT uptime", new(*truncatedError)},
+			{"", new(*truncatedError)},
+		}
+
+		Convey("getStats should return the matching error type", func() {
+			for _, c := range cases {
+				_, err := getStats(newReplyConn([]byte(c.reply)))
+				So(errors.As(err, c.target), ShouldBeTrue)
+			}
+		})
+
+		Convey("getServerStats should return the matching error type", func() {
+			cases[0].reply = "STAT  avg_latency_us:1\r\nEND\r\n"
+			for _, c := range cases {
+				_, err := getServerStats(newReplyConn([]byte(c.reply)))
+				So(errors.As(err, c.target), ShouldBeTrue)
+			}
+		})
+	})
+
+	Convey("Given a truncated reply", t, func() {
+		_, err := getStats(newReplyConn([]byte("STAT version 37.0.0\r\n")))
+
+		Convey("The error should wrap the read error", func() {
+			So(errors.Is(err, io.EOF), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given stat lines longer than the read buffer", t, func() {
+		args := strings.Repeat("--flag ", 2000)
+		stats, err := getStats(newReplyConn([]byte("STAT commandargs " + args + "\r\nSTAT version 37.0.0\r\nEND\r\n")))
+
+		Convey("They should be parsed whole", func() {
+			So(err, ShouldBeNil)
+			So(stats["commandargs"], ShouldEqual, args)
+			So(stats["version"], ShouldEqual, "37.0.0")
+		})
+	})
+
+	Convey("Given server stats without a space after the ';'", t, func() {
+		stats, err := getServerStats(newReplyConn([]byte("STAT 10.0.0.1:11211 up:5 soft_tko;found:3\r\nEND\r\n")))
+
+		Convey("Both parts of the line should be parsed", func() {
+			So(err, ShouldBeNil)
+			So(stats["10.0.0.1:11211"]["up"], ShouldEqual, "5")
+			So(stats["10.0.0.1:11211"]["soft_tko"], ShouldEqual, "1")
+			So(stats["10.0.0.1:11211"]["found"], ShouldEqual, "3")
+		})
+	})
+}
+
+// Seed the fuzzers with the recorded sessions and the fake garbage reply
+func addFuzzSeeds(f *testing.F, command string) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*.script"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, script := range scripts {
+		replies, err := mcroutertest.LoadScript(script)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add([]byte(replies[command]))
+	}
+	f.Add([]byte(mcroutertest.Garbage))
+	f.Add([]byte("STAT a b\r\nSTAT c\r\nEND\r\n"))
+}
+
+// checkParseError fails unless err is nil or one of the parser error types
+func checkParseError(t *testing.T, err error) {
+	var (
+		malformed *malformedLineError
+		reply     *replyError
+		truncated *truncatedError
+	)
+	if err != nil && !errors.As(err, &malformed) && !errors.As(err, &reply) && !errors.As(err, &truncated) {
+		t.Errorf("unexpected error type %T: %v", err, err)
+	}
+}
+
+func FuzzStats(f *testing.F) {
+	addFuzzSeeds(f, "stats all")
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		stats, err := getStats(newReplyConn(reply))
+		checkParseError(t, err)
+		for name := range stats {
+			if name == "" || strings.ContainsAny(name, " \n") {
+				t.Errorf("invalid stat name %q", name)
+			}
+		}
+	})
+}
+
+func FuzzServerStats(f *testing.F) {
+	addFuzzSeeds(f, "stats servers")
+	f.Fuzz(func(t *testing.T, reply []byte) {
+		servers, err := getServerStats(newReplyConn(reply))
+		checkParseError(t, err)
+		for server, stats := range servers {
+			if server == "" || strings.ContainsAny(server, " ;\n") {
+				t.Errorf("invalid server id %q", server)
+			}
+			for _, state := range append(memcachedStates, softTKOState, hardTKOState) {
+				if _, ok := stats[state]; !ok {
+					t.Errorf("missing baseline of %s for %q", state, server)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkStats(b *testing.B) {
+	replies, err := mcroutertest.LoadScript(filepath.Join("testdata", "mcrouter-37.script"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	reply := []byte(replies["stats all"])
+	b.SetBytes(int64(len(reply)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getStats(newReplyConn(reply)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
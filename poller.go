@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// startPolling polls mcrouter every interval in the background until the
+// exporter is closed, to observe what happens between two scrapes. Up to
+// history TKO transitions are kept for /debug/tko. The latencies are sampled
+// into native histograms when bucketFactor is greater than 1.
+func (e *Exporter) startPolling(interval time.Duration, history int, bucketFactor float64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.tko = newTKOTracker(history, e.serverFilter)
+	if bucketFactor > 1 {
+		e.samples = newLatencySampler(bucketFactor, e.collectors["servers"], e.serverFilter)
+	}
+	e.stopPolling = cancel
+	// Keep a connection for the poller besides the scrapes
+	e.pool.size++
+	go e.poll(ctx, interval)
+}
+
+func (e *Exporter) poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := e.pollOnce(); err != nil {
+			level.Debug(e.logger).Log("msg", "Failed to poll mcrouter", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollOnce fetches the stats of the servers and records their TKO
+// transitions, along with the stats of mcrouter when sampling latencies.
+func (e *Exporter) pollOnce() error {
+	commands := []string{"stats servers"}
+	if e.samples != nil {
+		commands = []string{"stats all", "stats servers"}
+	}
+	c, err := e.pool.get()
+	if err != nil {
+		return err
+	}
+	var stats map[string]string
+	var servers map[string]map[string]string
+	if err = c.SetDeadline(time.Now().Add(e.readTimeout)); err == nil {
+		if err = c.send(commands...); err == nil {
+			if e.samples != nil {
+				stats, err = parseStats(c.reader, "stats all")
+			}
+			if err == nil {
+				servers, err = parseServerStats(c.reader, "stats servers")
+			}
+		}
+	}
+	e.pool.put(c, err)
+	if err != nil {
+		return err
+	}
+
+	e.tko.observe(servers, time.Now())
+	if e.samples != nil {
+		e.samples.observe(stats, servers)
+	}
+	return nil
+}
+
+// close stops polling and closes the connections to mcrouter.
+func (e *Exporter) close() {
+	if e.stopPolling != nil {
+		e.stopPolling()
+	}
+	e.pool.close()
+}
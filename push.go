@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pusher delivers the metrics of a gatherer to a remote endpoint.
+type pusher interface {
+	push(ctx context.Context, g prometheus.Gatherer) error
+}
+
+// pushgatewayPusher pushes metrics to a Prometheus Pushgateway, replacing the
+// metrics previously pushed with the same grouping key. In a fleet, each
+// target is pushed as its own instance group.
+type pushgatewayPusher struct {
+	url       string
+	job       string
+	instance  string
+	perTarget bool
+	client    *http.Client
+
+	// Instance groups of the previous push, to delete those of the targets
+	// that are gone.
+	pushed map[string]bool
+}
+
+func (p *pushgatewayPusher) push(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	groups := groupByInstance(mfs, p.instance, p.perTarget)
+	var errs []error
+	for _, instance := range sortedInstances(groups) {
+		mfs := groups[instance]
+		err := push.New(p.url, p.job).
+			Grouping("instance", instance).
+			Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })).
+			Client(p.client).
+			PushContext(ctx)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for instance := range p.pushed {
+		if _, ok := groups[instance]; ok {
+			continue
+		}
+		if err := push.New(p.url, p.job).Grouping("instance", instance).Client(p.client).Delete(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(p.pushed, instance)
+	}
+	for instance := range groups {
+		p.pushed[instance] = true
+	}
+	return errors.Join(errs...)
+}
+
+// remoteWritePusher sends metrics to a Prometheus remote-write receiver as a
+// snappy-compressed protobuf WriteRequest. In a fleet, the instance label of
+// each series is its target.
+type remoteWritePusher struct {
+	url       string
+	job       string
+	instance  string
+	perTarget bool
+	client    *http.Client
+}
+
+func (p *remoteWritePusher) push(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	// Concatenated WriteRequest messages are merged into one by the decoder
+	var request []byte
+	now := time.Now()
+	groups := groupByInstance(mfs, p.instance, p.perTarget)
+	for _, instance := range sortedInstances(groups) {
+		extra := map[string]string{"job": p.job, "instance": instance}
+		request = append(request, encodeWriteRequest(groups[instance], extra, now)...)
+	}
+	body := snappy.Encode(nil, request)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status code %d while pushing to %s: %s", resp.StatusCode, p.url, msg)
+	}
+	return nil
+}
+
+// newPusher returns the pusher for the given push format. Metrics are pushed
+// as the given instance, or as the instance of their target label with
+// perTarget, when gathered from a fleet.
+func newPusher(format, url, job, instance string, perTarget bool, timeout time.Duration) (pusher, error) {
+	client := &http.Client{Timeout: timeout}
+	switch format {
+	case "pushgateway":
+		return &pushgatewayPusher{url: url, job: job, instance: instance, perTarget: perTarget, client: client, pushed: make(map[string]bool)}, nil
+	case "remote-write":
+		return &remoteWritePusher{url: url, job: job, instance: instance, perTarget: perTarget, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown push format %q", format)
+}
+
+// groupByInstance groups metric families by the instance they are pushed
+// as. With perTarget, the metrics of each target of a fleet form their own
+// group, and those without target label are pushed as instance.
+func groupByInstance(mfs []*dto.MetricFamily, instance string, perTarget bool) map[string][]*dto.MetricFamily {
+	if !perTarget {
+		return map[string][]*dto.MetricFamily{instance: mfs}
+	}
+	groups := make(map[string][]*dto.MetricFamily)
+	for _, mf := range mfs {
+		parts := make(map[string]*dto.MetricFamily)
+		for _, m := range mf.GetMetric() {
+			target := labelValue(m, "target")
+			if target == "" {
+				target = instance
+			}
+			part, ok := parts[target]
+			if !ok {
+				part = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+				parts[target] = part
+				groups[target] = append(groups[target], part)
+			}
+			part.Metric = append(part.Metric, m)
+		}
+	}
+	return groups
+}
+
+// sortedInstances returns the instances of groups in order.
+func sortedInstances(groups map[string][]*dto.MetricFamily) []string {
+	instances := make([]string, 0, len(groups))
+	for instance := range groups {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+// sharedGatherer shares the metrics of a gatherer between the sinks pushing
+// them: metrics are gathered at most once per interval, and sinks pushing
+// within the same interval get the same metrics, so that mcrouter is scraped
+// once whatever the number of sinks. Concurrent gathers are serialized.
+type sharedGatherer struct {
+	g        prometheus.Gatherer
+	interval time.Duration
+
+	mu sync.Mutex
+	// Metrics of the last successful gather, and when they were gathered.
+	mfs []*dto.MetricFamily
+	at  time.Time
+}
+
+func newSharedGatherer(g prometheus.Gatherer, interval time.Duration) *sharedGatherer {
+	return &sharedGatherer{g: g, interval: interval}
+}
+
+func (s *sharedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.at.IsZero() && time.Since(s.at) < s.interval {
+		return s.mfs, nil
+	}
+	mfs, err := s.g.Gather()
+	if err != nil {
+		// Not shared, so that retries gather again
+		return mfs, err
+	}
+	s.mfs, s.at = mfs, time.Now()
+	return mfs, nil
+}
+
+// runPusher pushes the metrics of g every interval until ctx is cancelled.
+// Failed pushes are retried with an exponential backoff, bounded by the
+// interval so that a slow receiver never delays the next push.
+func runPusher(ctx context.Context, p pusher, g prometheus.Gatherer, interval time.Duration, retries int, logger log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pushWithRetry(ctx, p, g, interval, retries, logger)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pushWithRetry(ctx context.Context, p pusher, g prometheus.Gatherer, interval time.Duration, retries int, logger log.Logger) {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := p.push(ctx, g)
+		if err == nil {
+			return
+		}
+		if attempt >= retries {
+			level.Error(logger).Log("msg", "Failed to push metrics", "attempts", attempt+1, "err", err)
+			return
+		}
+		level.Warn(logger).Log("msg", "Failed to push metrics, retrying", "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > interval {
+			backoff = interval
+		}
+	}
+}
+
+// encodeWriteRequest encodes metric families as a remote-write WriteRequest
+// protobuf message. Every series gets the extra labels attached and is
+// stamped with now. Native histograms are sent as native histogram samples,
+// which the receiver only ingests with its native-histograms feature enabled.
+func encodeWriteRequest(mfs []*dto.MetricFamily, extra map[string]string, now time.Time) []byte {
+	ts := now.UnixMilli()
+	var buf []byte
+
+	labelsOf := func(name string, m *dto.Metric, more ...string) map[string]string {
+		labels := map[string]string{"__name__": name}
+		for k, v := range extra {
+			labels[k] = v
+		}
+		for _, lp := range m.GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		for i := 0; i+1 < len(more); i += 2 {
+			labels[more[i]] = more[i+1]
+		}
+		return labels
+	}
+	series := func(name string, m *dto.Metric, value float64, more ...string) {
+		buf = appendMessage(buf, 1, encodeTimeSeries(labelsOf(name, m, more...), value, ts))
+	}
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				series(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				series(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				series(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					series(name, m, q.GetValue(), "quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64))
+				}
+				series(name+"_sum", m, s.GetSampleSum())
+				series(name+"_count", m, float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				if h.Schema != nil {
+					buf = appendMessage(buf, 1, encodeHistogramSeries(labelsOf(name, m), h, ts))
+					if len(h.GetBucket()) == 0 {
+						// Native histogram only
+						continue
+					}
+				}
+				for _, b := range h.GetBucket() {
+					series(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64))
+				}
+				series(name+"_bucket", m, float64(h.GetSampleCount()), "le", "+Inf")
+				series(name+"_sum", m, h.GetSampleSum())
+				series(name+"_count", m, float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return buf
+}
+
+// encodeTimeSeries encodes a single-sample TimeSeries message.
+func encodeTimeSeries(labels map[string]string, value float64, ts int64) []byte {
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts))
+
+	return appendMessage(encodeLabels(labels), 2, sample)
+}
+
+// encodeHistogramSeries encodes a TimeSeries message holding a single native
+// histogram, whose buckets keep the spans and delta-encoded counts of the
+// client.
+func encodeHistogramSeries(labels map[string]string, h *dto.Histogram, ts int64) []byte {
+	var hist []byte
+	hist = protowire.AppendTag(hist, 1, protowire.VarintType)
+	hist = protowire.AppendVarint(hist, h.GetSampleCount())
+	hist = protowire.AppendTag(hist, 3, protowire.Fixed64Type)
+	hist = protowire.AppendFixed64(hist, math.Float64bits(h.GetSampleSum()))
+	hist = protowire.AppendTag(hist, 4, protowire.VarintType)
+	hist = protowire.AppendVarint(hist, protowire.EncodeZigZag(int64(h.GetSchema())))
+	hist = protowire.AppendTag(hist, 5, protowire.Fixed64Type)
+	hist = protowire.AppendFixed64(hist, math.Float64bits(h.GetZeroThreshold()))
+	hist = protowire.AppendTag(hist, 6, protowire.VarintType)
+	hist = protowire.AppendVarint(hist, h.GetZeroCount())
+	hist = appendBuckets(hist, 8, h.GetNegativeSpan(), h.GetNegativeDelta())
+	hist = appendBuckets(hist, 11, h.GetPositiveSpan(), h.GetPositiveDelta())
+	hist = protowire.AppendTag(hist, 15, protowire.VarintType)
+	hist = protowire.AppendVarint(hist, uint64(ts))
+
+	return appendMessage(encodeLabels(labels), 4, hist)
+}
+
+// appendBuckets appends the spans of native histogram buckets as the field
+// num of a Histogram message, and their deltas as the packed field num+1.
+func appendBuckets(b []byte, num protowire.Number, spans []*dto.BucketSpan, deltas []int64) []byte {
+	for _, span := range spans {
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.VarintType)
+		s = protowire.AppendVarint(s, protowire.EncodeZigZag(int64(span.GetOffset())))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(span.GetLength()))
+		b = appendMessage(b, num, s)
+	}
+	if len(deltas) == 0 {
+		return b
+	}
+	var packed []byte
+	for _, d := range deltas {
+		packed = protowire.AppendVarint(packed, protowire.EncodeZigZag(d))
+	}
+	return appendMessage(b, num+1, packed)
+}
+
+// encodeLabels encodes the labels of a TimeSeries message, sorted by name as
+// required by the remote-write protocol.
+func encodeLabels(labels map[string]string) []byte {
+	var buf []byte
+	for _, name := range sortedKeys(labels) {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+		buf = appendMessage(buf, 1, label)
+	}
+	return buf
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "github.com/smartystreets/goconvey/convey"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Call fn for every field of the protobuf message b. Length-delimited fields
+// are passed as v, fixed64 and varint fields as u.
+func walkProto(t *testing.T, b []byte, fn func(num protowire.Number, v []byte, u uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			fn(num, v, 0)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			fn(num, nil, v)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			fn(num, nil, v)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+	}
+}
+
+// Decode a remote-write WriteRequest into one label map per series, with the
+// sample value stored under the "__value__" key
+func decodeWriteRequest(t *testing.T, b []byte) []map[string]string {
+	var series []map[string]string
+	walkProto(t, b, func(_ protowire.Number, ts []byte, _ uint64) {
+		labels := map[string]string{}
+		walkProto(t, ts, func(num protowire.Number, v []byte, _ uint64) {
+			if num == 1 {
+				var name, value string
+				walkProto(t, v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				labels[name] = value
+			} else if num == 2 {
+				walkProto(t, v, func(num protowire.Number, _ []byte, u uint64) {
+					if num == 1 {
+						labels["__value__"] = strconv.FormatFloat(math.Float64frombits(u), 'g', -1, 64)
+					}
+				})
+			} else {
+				// Native histogram, with its count, sum, schema and
+				// number of positive buckets
+				var buckets uint64
+				walkProto(t, v, func(num protowire.Number, _ []byte, u uint64) {
+					switch num {
+					case 1:
+						labels["__count__"] = strconv.FormatUint(u, 10)
+					case 3:
+						labels["__sum__"] = strconv.FormatFloat(math.Float64frombits(u), 'g', -1, 64)
+					case 4:
+						labels["__schema__"] = strconv.FormatInt(protowire.DecodeZigZag(u), 10)
+					case 11:
+						buckets++
+					}
+				})
+				labels["__spans__"] = strconv.FormatUint(buckets, 10)
+			}
+		})
+		series = append(series, labels)
+	})
+	return series
+}
+
+func TestRemoteWritePush(t *testing.T) {
+	Convey("Given a remote-write receiver", t, func() {
+		var (
+			mu       sync.Mutex
+			requests int
+			encoding string
+			series   []map[string]string
+		)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			requests++
+			// Fail the first request to exercise the retry path
+			if requests == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			encoding = r.Header.Get("Content-Encoding")
+			body, _ := io.ReadAll(r.Body)
+			b, err := snappy.Decode(nil, body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			series = decodeWriteRequest(t, b)
+		}))
+		defer receiver.Close()
+
+		Convey("When the exporter pushes metrics for an unreachable mcrouter", func() {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(NewExporter("127.0.0.1:1", 100*time.Millisecond, false, log.NewNopLogger()))
+
+			p, err := newPusher("remote-write", receiver.URL, "mcrouter", "127.0.0.1:1", false, time.Second)
+			So(err, ShouldBeNil)
+			pushWithRetry(context.Background(), p, registry, time.Second, 3, log.NewNopLogger())
+
+			Convey("It should retry and deliver mcrouter_up with the grouping labels", func() {
+				mu.Lock()
+				defer mu.Unlock()
+				So(requests, ShouldEqual, 2)
+				So(encoding, ShouldEqual, "snappy")
+				So(series, ShouldResemble, []map[string]string{{
+					"__name__": "mcrouter_up", "instance": "127.0.0.1:1", "job": "mcrouter", "__value__": "0",
+				}})
+			})
+		})
+	})
+}
+
+func TestRemoteWriteNativeHistograms(t *testing.T) {
+	Convey("Given a native histogram", t, func() {
+		h := prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:                        "mcrouter_duration_sample_seconds",
+			Help:                        "Distribution of the average request duration.",
+			NativeHistogramBucketFactor: 1.1,
+		})
+		h.Observe(0.001)
+		h.Observe(0.003)
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(h)
+		mfs, err := registry.Gather()
+		So(err, ShouldBeNil)
+
+		Convey("It should be written as a native histogram sample rather than classic series", func() {
+			series := decodeWriteRequest(t, encodeWriteRequest(mfs, map[string]string{"job": "mcrouter"}, time.Unix(1700000000, 0)))
+			So(series, ShouldResemble, []map[string]string{{
+				"__name__": "mcrouter_duration_sample_seconds", "job": "mcrouter",
+				"__count__": "2", "__sum__": "0.004", "__schema__": "3", "__spans__": "2",
+			}})
+		})
+	})
+}
+
+func TestSharedGatherer(t *testing.T) {
+	Convey("Given sinks sharing the gathers of an exporter", t, func() {
+		var (
+			mu      sync.Mutex
+			gathers int
+		)
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(NewExporter("127.0.0.1:1", 100*time.Millisecond, false, log.NewNopLogger()))
+		g := newSharedGatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			mu.Lock()
+			gathers++
+			mu.Unlock()
+			return registry.Gather()
+		}), 200*time.Millisecond)
+
+		Convey("Sinks pushing within the same interval should scrape mcrouter once", func() {
+			var wg sync.WaitGroup
+			gathered := make([][]*dto.MetricFamily, 3)
+			for i := range gathered {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					gathered[i], _ = g.Gather()
+				}(i)
+			}
+			wg.Wait()
+			So(gathers, ShouldEqual, 1)
+			So(gathered[0], ShouldNotBeEmpty)
+			So(gathered[1], ShouldResemble, gathered[0])
+			So(gathered[2], ShouldResemble, gathered[0])
+
+			Convey("And scrape it again on the next interval", func() {
+				time.Sleep(250 * time.Millisecond)
+				_, err := g.Gather()
+				So(err, ShouldBeNil)
+				So(gathers, ShouldEqual, 2)
+			})
+		})
+	})
+}
+
+func TestPushgatewayPush(t *testing.T) {
+	Convey("Given a Pushgateway", t, func() {
+		var path, method string
+		gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, method = r.URL.Path, r.Method
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer gateway.Close()
+
+		Convey("When the exporter pushes metrics", func() {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(NewExporter("127.0.0.1:1", 100*time.Millisecond, false, log.NewNopLogger()))
+
+			p, err := newPusher("pushgateway", gateway.URL, "mcrouter", "127.0.0.1:1", false, time.Second)
+			So(err, ShouldBeNil)
+			So(p.push(context.Background(), registry), ShouldBeNil)
+
+			Convey("It should replace the group of this mcrouter instance", func() {
+				So(method, ShouldEqual, http.MethodPut)
+				So(path, ShouldEqual, "/metrics/job/mcrouter/instance/127.0.0.1:1")
+			})
+		})
+	})
+}
+
+func TestFleetPush(t *testing.T) {
+	Convey("Given a fleet of two unreachable mcrouters", t, func() {
+		f := newFleet(staticTargets([]string{"127.0.0.1:1", "127.0.0.1:2"}), nil, func(target string) *Exporter {
+			return NewExporter(target, 100*time.Millisecond, false, log.NewNopLogger())
+		}, log.NewNopLogger())
+
+		Convey("When pushed to a Pushgateway", func() {
+			var (
+				mu       sync.Mutex
+				requests []string
+			)
+			gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests = append(requests, r.Method+" "+r.URL.Path)
+				if r.Method == http.MethodDelete {
+					w.WriteHeader(http.StatusAccepted)
+				}
+			}))
+			defer gateway.Close()
+
+			p, err := newPusher("pushgateway", gateway.URL, "mcrouter", "localhost:5000", true, time.Second)
+			So(err, ShouldBeNil)
+			So(p.push(context.Background(), f), ShouldBeNil)
+
+			Convey("Each target should replace its own instance group", func() {
+				So(requests, ShouldResemble, []string{
+					"PUT /metrics/job/mcrouter/instance/127.0.0.1:1",
+					"PUT /metrics/job/mcrouter/instance/127.0.0.1:2",
+				})
+			})
+
+			Convey("The group of a target that is gone should be deleted", func() {
+				f.setTargets(staticTargets([]string{"127.0.0.1:2"}))
+				requests = nil
+				So(p.push(context.Background(), f), ShouldBeNil)
+				So(requests, ShouldResemble, []string{
+					"PUT /metrics/job/mcrouter/instance/127.0.0.1:2",
+					"DELETE /metrics/job/mcrouter/instance/127.0.0.1:1",
+				})
+			})
+		})
+
+		Convey("When pushed to a remote-write receiver", func() {
+			var series []map[string]string
+			receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				b, err := snappy.Decode(nil, body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				series = decodeWriteRequest(t, b)
+			}))
+			defer receiver.Close()
+
+			p, err := newPusher("remote-write", receiver.URL, "mcrouter", "localhost:5000", true, time.Second)
+			So(err, ShouldBeNil)
+			So(p.push(context.Background(), f), ShouldBeNil)
+
+			Convey("The instance of each series should be its target", func() {
+				instances := make(map[string]string)
+				for _, s := range series {
+					instances[s["target"]] = s["instance"]
+				}
+				So(instances, ShouldResemble, map[string]string{"127.0.0.1:1": "127.0.0.1:1", "127.0.0.1:2": "127.0.0.1:2"})
+			})
+		})
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Dev25/mcrouter_exporter/internal/mcroutertest"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	recordHelp = "Record the replies of a live mcrouter to a session file."
+	replayHelp = "Serve a recorded session to the exporter's parsers."
+)
+
+// recordCommands are the commands recorded by default, covering everything
+// the exporter sends to mcrouter.
+var recordCommands = []string{
+	"stats all",
+	"stats servers",
+	"stats detailed",
+	"get __mcrouter__.options",
+	"get __mcrouter__.config_md5_digest",
+	"version",
+}
+
+// runRecord captures the raw replies of a mcrouter to the stats and service
+// info commands into a session file, in the script format of the fake
+// mcrouter (see internal/mcroutertest).
+func runRecord(args []string) error {
+	fs := newFlagSet("record", recordHelp)
+	var (
+		target   = fs.String("target", "localhost:5000", "mcrouter server TCP address (tcp4/tcp6) or UNIX socket path.")
+		out      = fs.String("out", "-", "Session file to write, - for stdout.")
+		timeout  = fs.Duration("timeout", 5*time.Second, "Timeout of the whole recording.")
+		commands = fs.String("commands", strings.Join(recordCommands, ","), "Comma-separated list of commands to record.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c, err := newConnPool(*target, *timeout).dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(*timeout)); err != nil {
+		return err
+	}
+
+	replies, err := record(c, strings.Split(*commands, ","))
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	fmt.Fprintf(w, "# Recorded from %s at %s\n", *target, time.Now().UTC().Format(time.RFC3339))
+	if version := versionOf(replies); version != "" {
+		fmt.Fprintf(w, "# mcrouter %s\n", version)
+	}
+	return mcroutertest.WriteScript(w, replies)
+}
+
+// record sends each command to mcrouter and returns the raw bytes of their
+// replies.
+func record(c *mcrouterConn, commands []string) (map[string]string, error) {
+	replies := make(map[string]string, len(commands))
+	for _, command := range commands {
+		command = strings.TrimSpace(command)
+		if command == "" {
+			continue
+		}
+		if err := c.send(command); err != nil {
+			return nil, err
+		}
+		reply, err := readReply(c.reader)
+		if err != nil {
+			return nil, fmt.Errorf("reading reply to %q: %w", command, err)
+		}
+		replies[command] = reply
+	}
+	return replies, nil
+}
+
+// readReply reads a whole reply to a stats, get or version command: up to
+// the END line, a single error or VERSION line, skipping over the data of
+// VALUE blocks.
+func readReply(reader *bufio.Reader) (string, error) {
+	var reply strings.Builder
+	for {
+		line, err := reader.ReadString('\n')
+		reply.WriteString(line)
+		if err != nil {
+			return reply.String(), err
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "END", "ERROR", "SERVER_ERROR", "CLIENT_ERROR", "VERSION":
+			return reply.String(), nil
+		case "VALUE":
+			if len(fields) < 4 {
+				continue
+			}
+			size, err := strconv.Atoi(fields[3])
+			if err != nil {
+				continue
+			}
+			// The value is followed by \r\n
+			data := make([]byte, size+2)
+			n, err := io.ReadFull(reader, data)
+			reply.Write(data[:n])
+			if err != nil {
+				return reply.String(), err
+			}
+		}
+	}
+}
+
+// recorded reports whether the session has a reply to command other than an
+// error, as mcrouter versions lacking a command answer it with ERROR.
+func recorded(replies map[string]string, command string) bool {
+	reply, ok := replies[command]
+	return ok && !strings.HasPrefix(reply, "ERROR")
+}
+
+// versionOf returns the mcrouter version found in recorded replies.
+func versionOf(replies map[string]string) string {
+	for _, line := range strings.Split(replies["stats all"], "\r\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "STAT" && fields[1] == "version" {
+			return fields[2]
+		}
+	}
+	return strings.TrimSpace(strings.TrimPrefix(replies["version"], "VERSION"))
+}
+
+// runReplay serves a recorded session with the fake mcrouter. By default it
+// scrapes the session once with every collector enabled and prints the
+// resulting metrics, so that parsing issues can be reproduced without a live
+// mcrouter; with -listen-address it keeps serving the session instead.
+func runReplay(args []string) error {
+	fs := newFlagSet("replay", replayHelp)
+	var (
+		session       = fs.String("session", "", "Session file written by the record command.")
+		listenAddress = fs.String("listen-address", "", "Address (or UNIX socket path) to serve the session on until interrupted, e.g. to point an exporter at it.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *session == "" {
+		return fmt.Errorf("-session is required")
+	}
+	replies, err := mcroutertest.LoadScript(*session)
+	if err != nil {
+		return err
+	}
+
+	address := *listenAddress
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+	s, err := mcroutertest.NewServer(address, replies)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if *listenAddress != "" {
+		fmt.Fprintf(os.Stderr, "Serving %s on %s\n", *session, s.Addr())
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		return nil
+	}
+	return replay(s.Addr(), replies, os.Stdout)
+}
+
+// replay scrapes the fake mcrouter at address with every collector the
+// session has replies for, and writes the metrics in the text format.
+// Parsing warnings are logged to stderr.
+func replay(address string, replies map[string]string, w io.Writer) error {
+	e := NewExporter(address, time.Second, recorded(replies, "stats servers"), log.NewLogfmtLogger(os.Stderr))
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(e); err != nil {
+		return err
+	}
+	return writeMetrics(w, registry)
+}
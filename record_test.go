@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dev25/mcrouter_exporter/internal/mcroutertest"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRecordReplay(t *testing.T) {
+	Convey("Given a fake mcrouter 37", t, func() {
+		s := startFakeMcrouter(t, "127.0.0.1:0", "mcrouter-37.script")
+		defer s.Close()
+		expected, err := mcroutertest.LoadScript(filepath.Join("testdata", "mcrouter-37.script"))
+		So(err, ShouldBeNil)
+
+		conn, err := net.Dial("tcp", s.Addr())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		Convey("Recording should capture the raw replies", func() {
+			replies, err := record(newMcrouterConn(conn), recordCommands)
+			So(err, ShouldBeNil)
+			for command, reply := range expected {
+				So(replies[command], ShouldEqual, reply)
+			}
+			So(replies["stats detailed"], ShouldEqual, "ERROR\r\n")
+			So(versionOf(replies), ShouldEqual, "37.0.0")
+
+			Convey("And the session should round-trip through a script", func() {
+				var buf bytes.Buffer
+				So(mcroutertest.WriteScript(&buf, replies), ShouldBeNil)
+				session, err := mcroutertest.ReadScript(&buf)
+				So(err, ShouldBeNil)
+				So(session, ShouldResemble, replies)
+			})
+		})
+
+		Convey("Replaying should scrape every recorded command", func() {
+			var buf bytes.Buffer
+			So(replay(s.Addr(), expected, &buf), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "mcrouter_up 1")
+			So(buf.String(), ShouldContainSubstring, "mcrouter_server_connections{")
+		})
+	})
+
+	Convey("A reply holding a value should be read up to its END line", t, func() {
+		// A 10 byte value made of END lines, which must not end the reply
+		reply := "VALUE __mcrouter__.options 0 10\r\nEND\r\nEND\r\n\r\nEND\r\n"
+		r := bufio.NewReader(strings.NewReader(reply + "VERSION 37.0.0\r\n"))
+		read, err := readReply(r)
+		So(err, ShouldBeNil)
+		So(read, ShouldEqual, reply)
+	})
+}
+
+// Every recorded session in testdata should parse without errors
+func TestSessionCorpus(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*.script"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range scripts {
+		Convey("Given the session "+script, t, func() {
+			s := startFakeMcrouter(t, "127.0.0.1:0", filepath.Base(script))
+			defer s.Close()
+			conn, err := net.Dial("tcp", s.Addr())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			Convey("The stats should parse", func() {
+				stats, err := getStats(conn)
+				So(err, ShouldBeNil)
+				So(stats, ShouldNotBeEmpty)
+			})
+
+			Convey("The server stats should parse", func() {
+				servers, err := getServerStats(conn)
+				So(err, ShouldBeNil)
+				So(servers, ShouldNotBeEmpty)
+			})
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	configReloadsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "config_reloads_total"),
+		"Number of config reloads of mcrouter observed by the exporter, by result (success or failure).",
+		[]string{"result"},
+		nil,
+	)
+	configAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "config_age_seconds"),
+		"Number of seconds since mcrouter last applied its config successfully.",
+		nil,
+		nil,
+	)
+	configFailingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "config_failing_seconds"),
+		"Number of seconds mcrouter has been failing to apply its config, 0 when the last attempt succeeded.",
+		nil,
+		nil,
+	)
+)
+
+// reloadTracker detects config reloads of mcrouter by comparing its config
+// stats across scrapes.
+type reloadTracker struct {
+	mu sync.Mutex
+	// Stats of the previous scrape, zero before the first one.
+	startTime         float64
+	configLastSuccess float64
+	configLastAttempt float64
+	configFailures    float64
+	// UNIX timestamp of the first failed attempt observed since the last
+	// success, zero when the config is not failing.
+	failingSince float64
+
+	successes float64
+	failures  float64
+}
+
+// reloadEvents are the reloads that happened between two scrapes.
+type reloadEvents struct {
+	succeeded bool
+	failures  float64
+}
+
+// observe records the config stats of a scrape and returns the reloads that
+// happened since the previous one. Nothing is reported across a restart of
+// mcrouter, which loads its config from scratch, nor for stats older than
+// those of the previous scrape, which would count the reloads between them
+// twice.
+func (t *reloadTracker) observe(startTime, attempt, success, failures float64) reloadEvents {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var events reloadEvents
+	if staleConfigStats(startTime, attempt, success, t.startTime, t.configLastAttempt, t.configLastSuccess) || t.startTime == startTime && failures < t.configFailures {
+		return events
+	}
+	if t.startTime != 0 && startTime == t.startTime {
+		events.succeeded = success > t.configLastSuccess
+		if failures > t.configFailures {
+			events.failures = failures - t.configFailures
+		} else if attempt > t.configLastAttempt && attempt > success {
+			// mcrouters without the config_failures stat
+			events.failures = 1
+		}
+	} else {
+		t.failingSince = 0
+	}
+	if events.succeeded {
+		t.successes++
+	}
+	t.failures += events.failures
+
+	switch {
+	case attempt <= success:
+		t.failingSince = 0
+	case t.failingSince == 0:
+		t.failingSince = attempt
+	}
+	t.startTime, t.configLastAttempt, t.configLastSuccess, t.configFailures = startTime, attempt, success, failures
+	return events
+}
+
+// collectReloads tracks the config reloads of mcrouter and exports them along
+// with the age of its config.
+func (e *Exporter) collectReloads(s map[string]string, ch chan<- prometheus.Metric) {
+	success := e.parse(s, "config_last_success")
+	events := e.reloads.observe(e.parse(s, "start_time"), e.parse(s, "config_last_attempt"), success, e.parse(s, "config_failures"))
+	if events.succeeded || events.failures > 0 {
+		e.logReloads(events, s)
+	}
+
+	now := float64(time.Now().Unix())
+	if _, ok := s["time"]; ok {
+		now = e.parse(s, "time")
+	}
+	age := now - success
+	if _, ok := s["config_age"]; ok {
+		age = e.parse(s, "config_age")
+	}
+	ch <- prometheus.MustNewConstMetric(configAgeDesc, prometheus.GaugeValue, age)
+
+	e.reloads.mu.Lock()
+	defer e.reloads.mu.Unlock()
+	failing := 0.0
+	if e.reloads.failingSince != 0 {
+		failing = now - e.reloads.failingSince
+	}
+	ch <- prometheus.MustNewConstMetric(configFailingDesc, prometheus.GaugeValue, failing)
+	ch <- prometheus.MustNewConstMetric(configReloadsDesc, prometheus.CounterValue, e.reloads.successes, "success")
+	ch <- prometheus.MustNewConstMetric(configReloadsDesc, prometheus.CounterValue, e.reloads.failures, "failure")
+}
+
+// logReloads logs an event per reload result, with the digest of the config
+// mcrouter runs with when it is available.
+func (e *Exporter) logReloads(events reloadEvents, s map[string]string) {
+	logger := log.With(e.logger, "config_last_attempt", s["config_last_attempt"], "config_last_success", s["config_last_success"])
+	if configMD5, err := e.configMD5(); err != nil {
+		level.Debug(e.logger).Log("msg", "Failed to get the config digest of mcrouter", "err", err)
+	} else if configMD5 != "" {
+		logger = log.With(logger, "config_md5", configMD5)
+	}
+
+	if events.succeeded {
+		level.Info(logger).Log("msg", "mcrouter reloaded its config", "result", "success")
+	}
+	if events.failures > 0 {
+		level.Warn(logger).Log("msg", "mcrouter failed to reload its config", "result", "failure", "failures", events.failures)
+	}
+}
+
+// configMD5 gets the digest of the config of mcrouter, empty when mcrouter
+// does not report it.
+func (e *Exporter) configMD5() (string, error) {
+	c, err := e.pool.get()
+	if err != nil {
+		return "", err
+	}
+	var configMD5 string
+	if err = c.SetDeadline(time.Now().Add(e.readTimeout)); err == nil {
+		if err = c.send("get __mcrouter__.config_md5_digest"); err == nil {
+			configMD5, _, err = readServiceInfo(c.reader, "__mcrouter__.config_md5_digest")
+		}
+	}
+	e.pool.put(c, err)
+	return configMD5, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigReloads(t *testing.T) {
+	Convey("Given a running mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{
+			"stats all": "STAT time 1700000600\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000300\r\n" +
+				"STAT config_last_success 1700000300\r\nSTAT config_failures 0\r\nEND\r\n",
+			"get __mcrouter__.config_md5_digest": "VALUE __mcrouter__.config_md5_digest 0 32\r\n0123456789abcdef0123456789abcdef\r\nEND\r\n",
+		})
+		defer l.Close()
+		var logs bytes.Buffer
+		e := NewExporter(l.Addr(), time.Second, false, log.NewLogfmtLogger(&logs))
+
+		values := gatherValues(t, e)
+		So(values[`mcrouter_config_reloads_total{result="success"}`], ShouldEqual, 0)
+		So(values[`mcrouter_config_reloads_total{result="failure"}`], ShouldEqual, 0)
+		So(values["mcrouter_config_age_seconds{}"], ShouldEqual, 300)
+		So(values["mcrouter_config_failing_seconds{}"], ShouldEqual, 0)
+
+		Convey("A newer successful config should count as a successful reload", func() {
+			l.SetReply("stats all", "STAT time 1700000700\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000650\r\n"+
+				"STAT config_last_success 1700000650\r\nSTAT config_failures 0\r\nEND\r\n")
+			values := gatherValues(t, e)
+			So(values[`mcrouter_config_reloads_total{result="success"}`], ShouldEqual, 1)
+			So(values["mcrouter_config_age_seconds{}"], ShouldEqual, 50)
+
+			Convey("It should be logged with the config digest", func() {
+				So(logs.String(), ShouldContainSubstring, `msg="mcrouter reloaded its config"`)
+				So(logs.String(), ShouldContainSubstring, "config_md5=0123456789abcdef0123456789abcdef")
+			})
+
+			Convey("A late scrape that read the previous config stats should not count the reload twice", func() {
+				l.SetReply("stats all", "STAT time 1700000600\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000300\r\n"+
+					"STAT config_last_success 1700000300\r\nSTAT config_failures 0\r\nEND\r\n")
+				gatherValues(t, e)
+				l.SetReply("stats all", "STAT time 1700000800\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000650\r\n"+
+					"STAT config_last_success 1700000650\r\nSTAT config_failures 0\r\nEND\r\n")
+				values := gatherValues(t, e)
+				So(values[`mcrouter_config_reloads_total{result="success"}`], ShouldEqual, 1)
+			})
+		})
+
+		Convey("Failed attempts should count as failed reloads and track the failing time", func() {
+			l.SetReply("stats all", "STAT time 1700000700\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000650\r\n"+
+				"STAT config_last_success 1700000300\r\nSTAT config_failures 2\r\nEND\r\n")
+			values := gatherValues(t, e)
+			So(values[`mcrouter_config_reloads_total{result="failure"}`], ShouldEqual, 2)
+			So(values["mcrouter_config_failing_seconds{}"], ShouldEqual, 50)
+			So(logs.String(), ShouldContainSubstring, `msg="mcrouter failed to reload its config" result=failure failures=2`)
+
+			Convey("The failing time should count from the first failure observed", func() {
+				l.SetReply("stats all", "STAT time 1700000800\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000780\r\n"+
+					"STAT config_last_success 1700000300\r\nSTAT config_failures 3\r\nEND\r\n")
+				values := gatherValues(t, e)
+				So(values[`mcrouter_config_reloads_total{result="failure"}`], ShouldEqual, 3)
+				So(values["mcrouter_config_failing_seconds{}"], ShouldEqual, 150)
+			})
+
+			Convey("A successful reload should end the failing state", func() {
+				l.SetReply("stats all", "STAT time 1700000800\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000780\r\n"+
+					"STAT config_last_success 1700000780\r\nSTAT config_failures 2\r\nEND\r\n")
+				values := gatherValues(t, e)
+				So(values[`mcrouter_config_reloads_total{result="success"}`], ShouldEqual, 1)
+				So(values["mcrouter_config_failing_seconds{}"], ShouldEqual, 0)
+			})
+		})
+
+		Convey("A restart should not count as a reload", func() {
+			l.SetReply("stats all", "STAT time 1700001100\r\nSTAT start_time 1700001000\r\nSTAT config_last_attempt 1700001000\r\n"+
+				"STAT config_last_success 1700001000\r\nSTAT config_failures 0\r\nEND\r\n")
+			values := gatherValues(t, e)
+			So(values[`mcrouter_config_reloads_total{result="success"}`], ShouldEqual, 0)
+			So(logs.String(), ShouldNotContainSubstring, "reload")
+		})
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons of a restart of mcrouter.
+const (
+	// mcrouter was restarted while failing to apply a new config, or right
+	// after reloading one, e.g. by a rollout of a config change.
+	restartReasonConfig = "config"
+	// Any other restart: crash, OOM kill, manual restart...
+	restartReasonProcess = "process"
+)
+
+var (
+	restartsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "restarts_total"),
+		"Number of restarts of mcrouter observed by the exporter, from changes of its start time.",
+		nil,
+		nil,
+	)
+	uptimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "uptime_seconds"),
+		"Number of seconds since mcrouter started.",
+		nil,
+		nil,
+	)
+	lastRestartDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_restart_timestamp_seconds"),
+		"UNIX timestamp of the last restart of mcrouter observed by the exporter, with its reason guessed from the config stats (config or process).",
+		[]string{"reason"},
+		nil,
+	)
+)
+
+// restartTracker detects restarts of mcrouter by comparing its start time
+// across scrapes.
+type restartTracker struct {
+	mu sync.Mutex
+	// Stats of the previous scrape, zero before the first one.
+	startTime         float64
+	configLastAttempt float64
+	configLastSuccess float64
+	// Whether the previous scrape found a config reload.
+	reloaded bool
+
+	restarts    float64
+	lastReason  string
+	lastRestart float64
+}
+
+// observe records the stats of a scrape and returns the reason of the
+// restart it reveals, or an empty string. Stats older than those of the
+// previous scrape are ignored: concurrent scrapes may finish out of order,
+// and the older start time would count as another restart.
+func (t *restartTracker) observe(startTime, configLastAttempt, configLastSuccess float64) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if staleConfigStats(startTime, configLastAttempt, configLastSuccess, t.startTime, t.configLastAttempt, t.configLastSuccess) {
+		return ""
+	}
+	reason := ""
+	if t.startTime != 0 && startTime != t.startTime {
+		reason = restartReasonProcess
+		// A restart while the config was failing or right after a reload is
+		// most likely meant to apply a new config.
+		if t.configLastAttempt > t.configLastSuccess || t.reloaded {
+			reason = restartReasonConfig
+		}
+		t.restarts++
+		t.lastReason, t.lastRestart = reason, startTime
+	}
+
+	t.reloaded = reason == "" && t.configLastSuccess != 0 && configLastSuccess != t.configLastSuccess
+	t.startTime, t.configLastAttempt, t.configLastSuccess = startTime, configLastAttempt, configLastSuccess
+	return reason
+}
+
+// staleConfigStats reports whether the start time and config stats read by
+// a scrape are older than those already observed.
+func staleConfigStats(startTime, attempt, success, prevStartTime, prevAttempt, prevSuccess float64) bool {
+	if startTime != prevStartTime {
+		return startTime < prevStartTime
+	}
+	return attempt < prevAttempt || success < prevSuccess
+}
+
+// collectRestarts tracks the restarts of mcrouter and exports them along
+// with its uptime.
+func (e *Exporter) collectRestarts(s map[string]string, ch chan<- prometheus.Metric) {
+	startTime := e.parse(s, "start_time")
+	if reason := e.restarts.observe(startTime, e.parse(s, "config_last_attempt"), e.parse(s, "config_last_success")); reason != "" {
+		level.Warn(e.logger).Log("msg", "mcrouter restarted", "reason", reason, "start_time", s["start_time"])
+	}
+
+	uptime := e.parse(s, "uptime")
+	if _, ok := s["uptime"]; !ok {
+		// Older mcrouters only report their start time
+		uptime = float64(time.Now().Unix()) - startTime
+	}
+	ch <- prometheus.MustNewConstMetric(uptimeDesc, prometheus.GaugeValue, uptime)
+
+	e.restarts.mu.Lock()
+	defer e.restarts.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(restartsDesc, prometheus.CounterValue, e.restarts.restarts)
+	if e.restarts.lastReason != "" {
+		ch <- prometheus.MustNewConstMetric(lastRestartDesc, prometheus.GaugeValue, e.restarts.lastRestart, e.restarts.lastReason)
+	}
+}
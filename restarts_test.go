@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRestartDetection(t *testing.T) {
+	Convey("Given a running mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{
+			"stats all": "STAT uptime 600\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000000\r\nSTAT config_last_success 1700000000\r\nEND\r\n",
+		})
+		defer l.Close()
+		e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+
+		values := gatherValues(t, e)
+		So(values["mcrouter_restarts_total{}"], ShouldEqual, 0)
+		So(values["mcrouter_uptime_seconds{}"], ShouldEqual, 600)
+		So(values, ShouldNotContainKey, `mcrouter_last_restart_timestamp_seconds{reason="process"}`)
+
+		Convey("A change of its start time should count as a process restart", func() {
+			l.SetReply("stats all", "STAT uptime 5\r\nSTAT start_time 1700001000\r\nSTAT config_last_attempt 1700001000\r\nSTAT config_last_success 1700001000\r\nEND\r\n")
+			values := gatherValues(t, e)
+			So(values["mcrouter_restarts_total{}"], ShouldEqual, 1)
+			So(values["mcrouter_uptime_seconds{}"], ShouldEqual, 5)
+			So(values[`mcrouter_last_restart_timestamp_seconds{reason="process"}`], ShouldEqual, 1700001000)
+
+			Convey("Further scrapes should not count it again", func() {
+				values := gatherValues(t, e)
+				So(values["mcrouter_restarts_total{}"], ShouldEqual, 1)
+			})
+
+			Convey("A late scrape that read the stats from before the restart should not count another one", func() {
+				l.SetReply("stats all", "STAT uptime 600\r\nSTAT start_time 1700000000\r\nSTAT config_last_attempt 1700000000\r\nSTAT config_last_success 1700000000\r\nEND\r\n")
+				gatherValues(t, e)
+				l.SetReply("stats all", "STAT uptime 10\r\nSTAT start_time 1700001000\r\nSTAT config_last_attempt 1700001000\r\nSTAT config_last_success 1700001000\r\nEND\r\n")
+				values := gatherValues(t, e)
+				So(values["mcrouter_restarts_total{}"], ShouldEqual, 1)
+				So(values[`mcrouter_config_reloads_total{result="success"}`], ShouldEqual, 0)
+			})
+		})
+
+		Convey("A restart while the config was failing should be config-triggered", func() {
+			l.SetReply("stats all", "STAT start_time 1700000000\r\nSTAT config_last_attempt 1700000500\r\nSTAT config_last_success 1700000000\r\nEND\r\n")
+			gatherValues(t, e)
+			l.SetReply("stats all", "STAT start_time 1700001000\r\nSTAT config_last_attempt 1700001000\r\nSTAT config_last_success 1700001000\r\nEND\r\n")
+			values := gatherValues(t, e)
+			So(values["mcrouter_restarts_total{}"], ShouldEqual, 1)
+			So(values[`mcrouter_last_restart_timestamp_seconds{reason="config"}`], ShouldEqual, 1700001000)
+		})
+
+		Convey("A restart right after a config reload should be config-triggered", func() {
+			l.SetReply("stats all", "STAT start_time 1700000000\r\nSTAT config_last_attempt 1700000500\r\nSTAT config_last_success 1700000500\r\nEND\r\n")
+			gatherValues(t, e)
+			l.SetReply("stats all", "STAT start_time 1700001000\r\nSTAT config_last_attempt 1700001000\r\nSTAT config_last_success 1700001000\r\nEND\r\n")
+			values := gatherValues(t, e)
+			So(values[`mcrouter_last_restart_timestamp_seconds{reason="config"}`], ShouldEqual, 1700001000)
+		})
+	})
+
+	Convey("Given an mcrouter without the uptime stat", t, func() {
+		start := time.Now().Add(-time.Hour).Unix()
+		l := serveCommands(t, map[string]string{"stats all": "STAT start_time " + strconv.FormatInt(start, 10) + "\r\nEND\r\n"})
+		defer l.Close()
+		e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+
+		Convey("The uptime should be derived from its start time", func() {
+			So(gatherValues(t, e)["mcrouter_uptime_seconds{}"], ShouldAlmostEqual, 3600, 5)
+		})
+	})
+}
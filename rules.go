@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+const rulesHelp = "Print Prometheus recording and alerting rules for the exporter's metrics."
+
+// ruleGroups is a Prometheus rules file.
+type ruleGroups struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// ruleOptions are the tunables of the generated rules.
+type ruleOptions struct {
+	// Labels the ratios are aggregated by, e.g. job,instance.
+	groupBy []string
+	// Range of the rates of the recording rules.
+	window time.Duration
+	// Duration an alert condition must hold before firing.
+	alertFor time.Duration
+	// Severity label of the alerts.
+	severity string
+
+	errorRatio    float64
+	tkoFraction   float64
+	configFailing time.Duration
+	restarts      int
+	restartWindow time.Duration
+}
+
+// generateRules builds the recording and alerting rules for the metrics of
+// the catalog. It fails when a rule references a metric the exporter does
+// not export.
+func generateRules(catalog map[string]catalogMetric, o ruleOptions) (ruleGroups, error) {
+	b := &queryBuilder{catalog: catalog}
+	by := strings.Join(o.groupBy, ", ")
+	window := model.Duration(o.window).String()
+	rateOf := func(metric, selector string) string {
+		return fmt.Sprintf("sum by (%s) (rate(%s%s[%s]))", by, b.metric(metric), selector, window)
+	}
+	hitRatio := "mcrouter:hit_ratio:rate" + window
+	errorRatio := "mcrouter:error_ratio:rate" + window
+	tkoFraction := "mcrouter:tko_fraction"
+
+	recording := ruleGroup{Name: "mcrouter.rules", Rules: []rule{
+		{
+			// Requires the servers collector
+			Record: hitRatio,
+			Expr: fmt.Sprintf("%s\n/\n(%s + %s)",
+				rateOf(namespace+"_server_memcached_found_count", ""),
+				rateOf(namespace+"_server_memcached_found_count", ""),
+				rateOf(namespace+"_server_memcached_not_found_count", "")),
+		},
+		{
+			// Every result_* reply is an error
+			Record: errorRatio,
+			Expr: fmt.Sprintf("%s\n/\n%s",
+				rateOf(namespace+"_result_count", ""),
+				rateOf(namespace+"_request_count", `{type="replied"}`)),
+		},
+		{
+			// Fraction of the destinations marked as TKO. mcrouter does not
+			// report the pool of the destinations, so it is computed over all
+			// the destinations of each router.
+			Record: tkoFraction,
+			Expr: fmt.Sprintf("(sum by (%s) (%s) + sum by (%s) (%s))\n/\ncount by (%s) (%s)",
+				by, b.metric(namespace+"_server_memcached_hard_tko"),
+				by, b.metric(namespace+"_server_memcached_soft_tko"),
+				by, b.metric(namespace+"_server_memcached_hard_tko")),
+		},
+	}}
+
+	alertFor := model.Duration(o.alertFor).String()
+	alert := func(name, expr, summary, description string) rule {
+		return rule{
+			Alert:       name,
+			Expr:        expr,
+			For:         alertFor,
+			Labels:      map[string]string{"severity": o.severity},
+			Annotations: map[string]string{"summary": summary, "description": description},
+		}
+	}
+	alerting := ruleGroup{Name: "mcrouter.alerts", Rules: []rule{
+		alert("McrouterDown",
+			b.metric(namespace+"_up")+" == 0",
+			"mcrouter is unreachable",
+			"The exporter cannot reach mcrouter on {{ $labels.instance }}."),
+		alert("McrouterConfigFailing",
+			fmt.Sprintf("%s > %g", b.metric(namespace+"_config_failing_seconds"), o.configFailing.Seconds()),
+			"mcrouter fails to apply its config",
+			"mcrouter on {{ $labels.instance }} has been failing to apply its config for {{ $value | humanizeDuration }}."),
+		alert("McrouterCrashLooping",
+			fmt.Sprintf("increase(%s[%s]) > %d", b.metric(namespace+"_restarts_total"), model.Duration(o.restartWindow), o.restarts),
+			"mcrouter keeps restarting",
+			fmt.Sprintf("mcrouter on {{ $labels.instance }} restarted {{ $value }} times in the last %s.", model.Duration(o.restartWindow))),
+		alert("McrouterHighErrorRatio",
+			fmt.Sprintf("%s > %g", errorRatio, o.errorRatio),
+			"mcrouter replies with errors",
+			"{{ $value | humanizePercentage }} of the replies of mcrouter on {{ $labels.instance }} are errors."),
+		alert("McrouterDestinationsTKO",
+			fmt.Sprintf("%s > %g", tkoFraction, o.tkoFraction),
+			"memcached destinations are marked as TKO",
+			"{{ $value | humanizePercentage }} of the memcached destinations of mcrouter on {{ $labels.instance }} are marked as TKO."),
+	}}
+
+	if err := b.err(); err != nil {
+		return ruleGroups{}, fmt.Errorf("rules %w", err)
+	}
+	return ruleGroups{Groups: []ruleGroup{recording, alerting}}, nil
+}
+
+// runRules prints the rules generated from the metric catalog as a
+// Prometheus rules file.
+func runRules(args []string) error {
+	fs := newFlagSet("rules", rulesHelp)
+	var (
+		out           = fs.String("out", "-", "Rules file to write, - for stdout.")
+		groupBy       = fs.String("group-by", "job,instance", "Comma-separated list of labels the recording rules aggregate by, e.g. job,target in fleet mode.")
+		window        = fs.Duration("window", 5*time.Minute, "Range of the rates of the recording rules.")
+		alertFor      = fs.Duration("for", 5*time.Minute, "Duration an alert condition must hold before the alert fires.")
+		severity      = fs.String("severity", "warning", "Severity label of the alerts.")
+		errorRatio    = fs.Float64("error-ratio", 0.01, "Fraction of error replies above which McrouterHighErrorRatio fires.")
+		tkoFraction   = fs.Float64("tko-fraction", 0.1, "Fraction of destinations marked as TKO above which McrouterDestinationsTKO fires.")
+		configFailing = fs.Duration("config-failing", 10*time.Minute, "Duration of config failures after which McrouterConfigFailing fires.")
+		restarts      = fs.Int("restarts", 3, "Number of restarts within -restart-window above which McrouterCrashLooping fires.")
+		restartWindow = fs.Duration("restart-window", 15*time.Minute, "Window the restarts of McrouterCrashLooping are counted over.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	catalog, err := metricCatalog()
+	if err != nil {
+		return err
+	}
+	groups, err := generateRules(catalog, ruleOptions{
+		groupBy:       strings.Split(*groupBy, ","),
+		window:        *window,
+		alertFor:      *alertFor,
+		severity:      *severity,
+		errorRatio:    *errorRatio,
+		tkoFraction:   *tkoFraction,
+		configFailing: *configFailing,
+		restarts:      *restarts,
+		restartWindow: *restartWindow,
+	})
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	fmt.Fprintf(w, "# Generated by: %s\n", strings.Join(append([]string{"mcrouter_exporter rules"}, args...), " "))
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(groups); err != nil {
+		return err
+	}
+	return enc.Close()
+}
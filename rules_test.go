@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/yaml.v3"
+)
+
+// Gather the names of the metrics emitted by a scrape of mcrouter 37 with
+// every collector enabled
+func emittedMetrics(t *testing.T) map[string]bool {
+	s := startFakeMcrouter(t, "127.0.0.1:0", "mcrouter-37.script")
+	defer s.Close()
+	e := NewExporter(s.Addr(), time.Second, true, log.NewNopLogger())
+	for name := range e.collectors {
+		e.collectors[name] = true
+	}
+	e.options = []string{"num-proxies"}
+
+	names := make(map[string]bool)
+	for key := range gatherValues(t, e) {
+		names[key[:bytes.IndexByte([]byte(key), '{')]] = true
+	}
+	return names
+}
+
+func TestRules(t *testing.T) {
+	Convey("Given the metric catalog", t, func() {
+		catalog, err := metricCatalog()
+		So(err, ShouldBeNil)
+
+		Convey("It should describe every metric the exporter emits", func() {
+			for name := range emittedMetrics(t) {
+				So(catalog, ShouldContainKey, name)
+			}
+			So(catalog[namespace+"_server_tko_transitions_total"].labels, ShouldResemble, []string{"server", "kind"})
+		})
+
+		Convey("When generating the rules", func() {
+			out := filepath.Join(t.TempDir(), "mcrouter.rules.yml")
+			So(runRules([]string{"-out", out, "-group-by", "job,target", "-error-ratio", "0.05"}), ShouldBeNil)
+			content, err := os.ReadFile(out)
+			So(err, ShouldBeNil)
+
+			var groups ruleGroups
+			So(yaml.Unmarshal(content, &groups), ShouldBeNil)
+
+			Convey("It should emit recording and alerting rules with the given tunables", func() {
+				So(groups.Groups, ShouldHaveLength, 2)
+				So(groups.Groups[0].Rules[1].Record, ShouldEqual, "mcrouter:error_ratio:rate5m")
+				So(groups.Groups[0].Rules[1].Expr, ShouldContainSubstring, "sum by (job, target)")
+				So(string(content), ShouldContainSubstring, "expr: mcrouter:error_ratio:rate5m > 0.05")
+			})
+
+			Convey("Its expressions should only reference metrics the exporter emits", func() {
+				emitted := emittedMetrics(t)
+				referenced := 0
+				for _, group := range groups.Groups {
+					for _, r := range group.Rules {
+						for _, name := range metricNamePattern.FindAllString(r.Expr, -1) {
+							So(emitted, ShouldContainKey, name)
+							referenced++
+						}
+					}
+				}
+				So(referenced, ShouldBeGreaterThan, 5)
+			})
+		})
+
+		Convey("Rules referencing unknown metrics should be rejected", func() {
+			delete(catalog, namespace+"_up")
+			_, err := generateRules(catalog, ruleOptions{groupBy: []string{"instance"}})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "mcrouter_up")
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencySampler feeds the average latencies reported by mcrouter, which
+// only hold at the time of a scrape, into native histograms on every poll,
+// to get their distribution between two scrapes. Native histograms are only
+// exposed in the protobuf format, which Prometheus negotiates when its
+// native-histograms feature is enabled.
+type latencySampler struct {
+	duration prometheus.Histogram
+	// Per-server histograms, nil when the servers collector is disabled.
+	servers *prometheus.HistogramVec
+	filter  *serverFilter
+	// Servers sampled by the previous poll, to delete the histograms of the
+	// servers that are gone. Only used by the polling goroutine.
+	sampled map[string]bool
+}
+
+// newLatencySampler creates the histograms, whose buckets grow by at most
+// bucketFactor. Per-server histograms are only created with perServer, for
+// the servers kept by the filter.
+func newLatencySampler(bucketFactor float64, perServer bool, filter *serverFilter) *latencySampler {
+	opts := func(name, help string) prometheus.HistogramOpts {
+		return prometheus.HistogramOpts{
+			Namespace:                       namespace,
+			Name:                            name,
+			Help:                            help,
+			NativeHistogramBucketFactor:     bucketFactor,
+			NativeHistogramMaxBucketNumber:  160,
+			NativeHistogramMinResetDuration: time.Hour,
+		}
+	}
+	s := &latencySampler{
+		duration: prometheus.NewHistogram(opts("duration_sample_seconds",
+			"Distribution of the average request duration of mcrouter (duration_us), sampled by the background polling.")),
+		filter:  filter,
+		sampled: make(map[string]bool),
+	}
+	if perServer {
+		s.servers = prometheus.NewHistogramVec(opts("server_duration_sample_seconds",
+			"Distribution of the average latency of the server (avg_latency_us), sampled by the background polling (per-server metric)."),
+			[]string{"server"})
+	}
+	return s
+}
+
+// observe samples the stats of a poll.
+func (s *latencySampler) observe(stats map[string]string, servers map[string]map[string]string) {
+	if _, ok := stats["duration_us"]; ok {
+		s.duration.Observe(parseServerStat(stats, "duration_us") / 1e6)
+	}
+	if s.servers == nil {
+		return
+	}
+
+	kept := s.filter.apply(servers)
+	for server, metrics := range kept {
+		if _, ok := metrics["avg_latency_us"]; ok {
+			s.servers.WithLabelValues(server).Observe(parseServerStat(metrics, "avg_latency_us") / 1e6)
+			s.sampled[server] = true
+		}
+	}
+	for server := range s.sampled {
+		if _, ok := kept[server]; !ok {
+			s.servers.DeleteLabelValues(server)
+			delete(s.sampled, server)
+		}
+	}
+}
+
+func (s *latencySampler) describe(ch chan<- *prometheus.Desc) {
+	s.duration.Describe(ch)
+	if s.servers != nil {
+		s.servers.Describe(ch)
+	}
+}
+
+func (s *latencySampler) collect(ch chan<- prometheus.Metric) {
+	s.duration.Collect(ch)
+	if s.servers != nil {
+		s.servers.Collect(ch)
+	}
+}
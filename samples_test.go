@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// Gather the histograms of a collector as a map of name{labels} to histogram
+func gatherHistograms(t *testing.T, c prometheus.Collector) map[string]*dto.Histogram {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	histograms := make(map[string]*dto.Histogram)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if m.Histogram == nil {
+				continue
+			}
+			var labels []string
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, lp.GetName()+"="+strconv.Quote(lp.GetValue()))
+			}
+			histograms[mf.GetName()+"{"+strings.Join(labels, ",")+"}"] = m.GetHistogram()
+		}
+	}
+	return histograms
+}
+
+// sampledCollector exposes the histograms of a sampler
+type sampledCollector struct{ s *latencySampler }
+
+func (c sampledCollector) Describe(ch chan<- *prometheus.Desc) { c.s.describe(ch) }
+func (c sampledCollector) Collect(ch chan<- prometheus.Metric) { c.s.collect(ch) }
+
+func TestLatencySampler(t *testing.T) {
+	Convey("Given latencies sampled over three polls", t, func() {
+		filter, err := newServerFilter("", "skipped", 0, "latency", false)
+		So(err, ShouldBeNil)
+		s := newLatencySampler(1.1, true, filter)
+		servers := func(latencies map[string]string) map[string]map[string]string {
+			m := make(map[string]map[string]string)
+			for server, latency := range latencies {
+				m[server] = map[string]string{"avg_latency_us": latency}
+			}
+			return m
+		}
+		s.observe(map[string]string{"duration_us": "1000"}, servers(map[string]string{"a": "200", "b": "5000", "skipped": "1"}))
+		s.observe(map[string]string{"duration_us": "3000"}, servers(map[string]string{"a": "400", "b": "5000"}))
+		s.observe(map[string]string{}, servers(map[string]string{"a": "600"}))
+
+		histograms := gatherHistograms(t, sampledCollector{s})
+
+		Convey("The router duration should be a native histogram of the samples in seconds", func() {
+			h := histograms[namespace+"_duration_sample_seconds{}"]
+			So(h, ShouldNotBeNil)
+			So(h.GetSampleCount(), ShouldEqual, 2)
+			So(h.GetSampleSum(), ShouldAlmostEqual, 0.004)
+			So(h.GetSchema(), ShouldEqual, 3)
+			So(h.GetPositiveSpan(), ShouldNotBeEmpty)
+		})
+
+		Convey("Each server kept by the filter should have its own histogram", func() {
+			a := histograms[namespace+`_server_duration_sample_seconds{server="a"}`]
+			So(a, ShouldNotBeNil)
+			So(a.GetSampleCount(), ShouldEqual, 3)
+			So(a.GetSampleSum(), ShouldAlmostEqual, 0.0012)
+			So(histograms, ShouldNotContainKey, namespace+`_server_duration_sample_seconds{server="skipped"}`)
+		})
+
+		Convey("The histograms of the servers that are gone should be deleted", func() {
+			So(histograms, ShouldNotContainKey, namespace+`_server_duration_sample_seconds{server="b"}`)
+		})
+	})
+
+	Convey("Without per-server metrics only the router duration should be sampled", t, func() {
+		s := newLatencySampler(1.1, false, nil)
+		s.observe(map[string]string{"duration_us": "1000"}, map[string]map[string]string{"a": {"avg_latency_us": "200"}})
+		histograms := gatherHistograms(t, sampledCollector{s})
+		So(histograms, ShouldHaveLength, 1)
+		So(histograms, ShouldContainKey, namespace+"_duration_sample_seconds{}")
+	})
+
+	Convey("Given an exporter polling a remote mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{
+			"stats all":     "STAT version 37.0.0\r\nSTAT duration_us 250\r\nEND\r\n",
+			"stats servers": "STAT 10.0.0.1:11211:ascii:plain:notcompressed-1000 avg_latency_us:302.991 pending_reqs:0 inflight_reqs:0 up:1\r\nEND\r\n",
+		})
+		defer l.Close()
+		e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+		e.collectors["servers"] = true
+		e.startPolling(time.Hour, 10, 1.1)
+		defer e.close()
+
+		Convey("Its scrapes should include the histograms sampled by the first poll", func() {
+			server := namespace + `_server_duration_sample_seconds{server="10.0.0.1:11211:ascii:plain:notcompressed-1000"}`
+			var histograms map[string]*dto.Histogram
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+				histograms = gatherHistograms(t, e)
+				if histograms[server].GetSampleCount() > 0 {
+					break
+				}
+			}
+			So(histograms[namespace+"_duration_sample_seconds{}"].GetSampleSum(), ShouldAlmostEqual, 0.00025)
+			So(histograms[server].GetSampleSum(), ShouldAlmostEqual, 0.000302991)
+		})
+	})
+}
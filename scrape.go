@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const scrapeHelp = "Scrape a mcrouter once and print its metrics, stats or a summary."
+
+// Operations of the cmd_<op> stats.
+var commandOps = []string{"add", "append", "cas", "decr", "flushall", "flushre", "get", "gets", "incr", "metaget", "prepend", "replace", "touch", "set", "delete", "lease_get", "lease_set"}
+
+// runScrape scrapes a mcrouter once. The prom format prints the metrics of
+// the exporter, json the raw stats as a snapshot, and table a summary of the
+// router along with its worst destinations. All of them fail when mcrouter
+// cannot be scraped.
+func runScrape(args []string) error {
+	fs := newFlagSet("scrape", scrapeHelp)
+	var (
+		target  = fs.String("target", "localhost:5000", "mcrouter server TCP address (tcp4/tcp6) or UNIX socket path.")
+		format  = fs.String("format", "prom", "Output format, one of: prom, json, table.")
+		out     = fs.String("out", "-", "File to write the output to, - for stdout.")
+		timeout = fs.Duration("timeout", 5*time.Second, "Timeout of the scrape.")
+		top     = fs.Int("top", 20, "Number of destinations listed by the table format, 0 lists all.")
+		sortBy  = fs.String("sort", "latency", "Ranking of the destinations of the table format, one of: "+strings.Join(serverSortNames(), ", ")+".")
+	)
+	collectorFlags := registerCollectorFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "prom":
+		e := NewExporter(*target, *timeout, false, log.NewLogfmtLogger(os.Stderr))
+		collectorFlags.apply(e)
+		e.readTimeout = *timeout
+		registry := prometheus.NewRegistry()
+		if err := registry.Register(e); err != nil {
+			return err
+		}
+		mfs, err := registry.Gather()
+		if err != nil {
+			return err
+		}
+		if err := writeMetrics(w, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })); err != nil {
+			return err
+		}
+		// The metrics still tell why, but scripts should not mistake
+		// mcrouter_up 0 for a successful scrape
+		if !mcrouterUp(mfs) {
+			return fmt.Errorf("failed to scrape mcrouter at %s", *target)
+		}
+		return nil
+	case "json":
+		s, err := takeSnapshot(*target, *timeout)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	case "table":
+		score, ok := serverSorts[*sortBy]
+		if !ok {
+			return fmt.Errorf("unknown sort %q, expected one of: %s", *sortBy, strings.Join(serverSortNames(), ", "))
+		}
+		s, err := takeSnapshot(*target, *timeout)
+		if err != nil {
+			return err
+		}
+		writeSummary(w, nil, s)
+		fmt.Fprintln(w)
+		return writeServerTable(w, s.Servers, rankServers(s.Servers, score, *top))
+	}
+	return fmt.Errorf("unknown format %q, expected prom, json or table", *format)
+}
+
+// mcrouterUp reports whether gathered metrics come from a successful scrape
+// of mcrouter.
+func mcrouterUp(mfs []*dto.MetricFamily) bool {
+	for _, mf := range mfs {
+		if mf.GetName() == prometheus.BuildFQName(namespace, "", "up") {
+			for _, m := range mf.GetMetric() {
+				return m.GetGauge().GetValue() == 1
+			}
+		}
+	}
+	return false
+}
+
+// writeSummary prints the state of the router and its request and error
+// rates. The rates are computed from the counters of the previous snapshot
+// when there is one, and are the averages of mcrouter otherwise.
+func writeSummary(w io.Writer, prev, s *snapshot) {
+	stat := func(name string) float64 {
+		return parseServerStat(s.Stats, name)
+	}
+	fmt.Fprintf(w, "mcrouter %s on %s, up %s\n", s.Stats["version"], s.Target, time.Duration(stat("uptime"))*time.Second)
+	config := "ok"
+	if stat("config_last_attempt") > stat("config_last_success") {
+		config = "FAILING"
+	}
+	fmt.Fprintf(w, "Config: %s, age %s, %g failures\n", config, time.Duration(stat("config_age"))*time.Second, stat("config_failures"))
+	fmt.Fprintf(w, "Requests: %g processing, %g waiting, %gus average duration\n",
+		stat("proxy_reqs_processing"), stat("proxy_reqs_waiting"), stat("duration_us"))
+	fmt.Fprintf(w, "Servers: %g up, %g down, %g new, %g closed\n",
+		stat("num_servers_up"), stat("num_servers_down"), stat("num_servers_new"), stat("num_servers_closed"))
+
+	var commands []string
+	for _, op := range commandOps {
+		if v := statRate(prev, s, "cmd_"+op); v != 0 {
+			commands = append(commands, fmt.Sprintf("%s %g", op, v))
+		}
+	}
+	fmt.Fprintf(w, "Commands/s: %s\n", joinOrNone(commands))
+
+	var results []string
+	for name := range s.Stats {
+		if reply, ok := resultName(name); ok {
+			if v := statRate(prev, s, name); v != 0 {
+				results = append(results, fmt.Sprintf("%s %g", reply, v))
+			}
+		}
+	}
+	sort.Strings(results)
+	fmt.Fprintf(w, "Errors/s: %s\n", joinOrNone(results))
+}
+
+// statRate returns the rate of a rate stat of mcrouter, from its <stat>_count
+// counter since the previous snapshot when possible.
+func statRate(prev, s *snapshot, name string) float64 {
+	counter := name + "_count"
+	if prev != nil && prev.Stats[counter] != "" && s.Stats[counter] != "" {
+		elapsed := s.Time.Sub(prev.Time).Seconds()
+		rate := (parseServerStat(s.Stats, counter) - parseServerStat(prev.Stats, counter)) / elapsed
+		// Counters restart along with mcrouter
+		if elapsed > 0 && rate >= 0 {
+			return math.Round(rate*100) / 100
+		}
+	}
+	return parseServerStat(s.Stats, name)
+}
+
+// resultName returns the reply of a result_<reply> stat, which is the
+// average rate of the error replies for normal requests.
+func resultName(stat string) (string, bool) {
+	reply, ok := strings.CutPrefix(stat, "result_")
+	if !ok || strings.HasSuffix(reply, "_count") || strings.HasSuffix(reply, "_all") {
+		return "", false
+	}
+	return reply, true
+}
+
+func joinOrNone(items []string) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	return strings.Join(items, ", ")
+}
+
+// serverErrors sums the error replies of a destination.
+func serverErrors(stats map[string]string) float64 {
+	return parseServerStat(stats, "remote_error") + parseServerStat(stats, "timeout") + parseServerStat(stats, "connect_timeout")
+}
+
+// serverSorts ranks the destinations listed by scrape and top, worst first.
+var serverSorts = map[string]func(stats map[string]string) float64{
+	"latency":  func(stats map[string]string) float64 { return parseServerStat(stats, "avg_latency_us") },
+	"pending":  func(stats map[string]string) float64 { return parseServerStat(stats, "pending_reqs") },
+	"inflight": func(stats map[string]string) float64 { return parseServerStat(stats, "inflight_reqs") },
+	"retrans":  func(stats map[string]string) float64 { return parseServerStat(stats, "avg_retrans_ratio") },
+	"errors":   serverErrors,
+	"tko": func(stats map[string]string) float64 {
+		// TKO destinations first, then by latency
+		return 1e12*(parseServerStat(stats, softTKOState)+parseServerStat(stats, hardTKOState)) +
+			parseServerStat(stats, "avg_latency_us")
+	},
+}
+
+func serverSortNames() []string {
+	names := make([]string, 0, len(serverSorts))
+	for name := range serverSorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rankServers returns the names of the n worst destinations by score, or of
+// all of them when n is 0.
+func rankServers(servers map[string]map[string]string, score func(map[string]string) float64, n int) []string {
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		si, sj := score(servers[names[i]]), score(servers[names[j]])
+		if si != sj {
+			return si > sj
+		}
+		return names[i] < names[j]
+	})
+	if n > 0 && len(names) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+// writeServerTable prints the given destinations in order.
+func writeServerTable(w io.Writer, servers map[string]map[string]string, names []string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tLATENCY(us)\tPENDING\tINFLIGHT\tRETRANS\tTKO\tERRORS")
+	for _, name := range names {
+		stats := servers[name]
+		tko := "-"
+		switch {
+		case stats[hardTKOState] == "1":
+			tko = "hard"
+		case stats[softTKOState] == "1":
+			tko = "soft"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%g\n", name,
+			formatStat(stats, "avg_latency_us"), formatStat(stats, "pending_reqs"), formatStat(stats, "inflight_reqs"),
+			formatStat(stats, "avg_retrans_ratio"), tko, serverErrors(stats))
+	}
+	return tw.Flush()
+}
+
+// formatStat formats a numeric stat compactly, - when it is missing.
+func formatStat(stats map[string]string, name string) string {
+	v, err := strconv.ParseFloat(stats[name], 64)
+	if err != nil {
+		return "-"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
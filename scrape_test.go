@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScrape(t *testing.T) {
+	Convey("Given a fake mcrouter 37", t, func() {
+		s := startFakeMcrouter(t, "127.0.0.1:0", "mcrouter-37.script")
+		defer s.Close()
+		out := filepath.Join(t.TempDir(), "out")
+		scrape := func(args ...string) string {
+			So(runScrape(append([]string{"-target", s.Addr(), "-out", out}, args...)), ShouldBeNil)
+			content, err := os.ReadFile(out)
+			So(err, ShouldBeNil)
+			return string(content)
+		}
+
+		Convey("The prom format should print the metrics of one collection", func() {
+			metrics := scrape()
+			So(metrics, ShouldContainSubstring, "mcrouter_up 1\n")
+			So(metrics, ShouldContainSubstring, `mcrouter_version{version="37.0.0"} 1`)
+			So(metrics, ShouldNotContainSubstring, "mcrouter_server_")
+		})
+
+		Convey("The json format should print a snapshot that reads back", func() {
+			scrape("-format", "json")
+			snap, err := readSnapshot(out)
+			So(err, ShouldBeNil)
+			So(snap.Target, ShouldEqual, s.Addr())
+			So(snap.Stats["cmd_get"], ShouldEqual, "150.5")
+			So(snap.Servers, ShouldHaveLength, 2)
+			So(snap.Servers["10.0.0.2:11211:ascii:plain:notcompressed-1000"][softTKOState], ShouldEqual, "1")
+		})
+
+		Convey("The table format should summarize the router and its worst destinations", func() {
+			table := scrape("-format", "table", "-sort", "errors", "-top", "1")
+			So(table, ShouldContainSubstring, "Commands/s: get 150.5, set 20.25, delete 2\n")
+			So(table, ShouldContainSubstring, "connect_timeout")
+			lines := strings.Split(strings.TrimSpace(table[strings.Index(table, "SERVER"):]), "\n")
+			So(lines, ShouldHaveLength, 2)
+			So(strings.Fields(lines[1]), ShouldResemble,
+				[]string{"10.0.0.2:11211:ascii:plain:notcompressed-1000", "1503.4", "4", "2", "0.5", "soft", "95"})
+		})
+
+		Convey("The prom format should fail for an unreachable mcrouter", func() {
+			err := runScrape([]string{"-target", "127.0.0.1:1", "-timeout", "100ms", "-out", out})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "failed to scrape mcrouter at 127.0.0.1:1")
+			content, err := os.ReadFile(out)
+			So(err, ShouldBeNil)
+			So(string(content), ShouldContainSubstring, "mcrouter_up 0\n")
+		})
+
+		Convey("An unknown format should be rejected", func() {
+			So(runScrape([]string{"-target", s.Addr(), "-out", out, "-format", "xml"}), ShouldNotBeNil)
+		})
+	})
+}
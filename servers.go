@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Label value of the bucket aggregating the servers that were filtered out.
+const otherServer = "other"
+
+// Per-server stats that are averages rather than totals, and therefore must
+// be averaged when servers are aggregated.
+var averagedServerStats = map[string]bool{
+	"avg_latency_us":    true,
+	"avg_retrans_ratio": true,
+}
+
+// Per-server stats that are extrema, aggregated as the extremum of the
+// servers.
+var extremeServerStats = map[string]func(x, y float64) float64{
+	"max_retrans_ratio": math.Max,
+	"min_retrans_ratio": math.Min,
+}
+
+// serverFilter limits the number of servers exported by the per-server
+// metrics, which on routers fronting thousands of memcached hosts would
+// otherwise produce an unbounded number of series.
+type serverFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+
+	// Keep only the topK servers ranked by topKBy, 0 keeps all of them.
+	topK   int
+	topKBy string
+
+	// Aggregate the servers that were filtered out into server="other"
+	// rather than dropping them.
+	aggregate bool
+}
+
+// newServerFilter validates the filtering options and compiles the regular
+// expressions. Empty expressions disable the corresponding filter.
+func newServerFilter(include, exclude string, topK int, topKBy string, aggregate bool) (*serverFilter, error) {
+	f := &serverFilter{topK: topK, topKBy: topKBy, aggregate: aggregate}
+	var err error
+	if include != "" {
+		if f.include, err = regexp.Compile(include); err != nil {
+			return nil, fmt.Errorf("invalid server include regex: %w", err)
+		}
+	}
+	if exclude != "" {
+		if f.exclude, err = regexp.Compile(exclude); err != nil {
+			return nil, fmt.Errorf("invalid server exclude regex: %w", err)
+		}
+	}
+	switch topKBy {
+	case "latency", "errors", "tko":
+	default:
+		return nil, fmt.Errorf("invalid server top-k ranking %q, must be one of: latency, errors, tko", topKBy)
+	}
+	return f, nil
+}
+
+// apply returns the servers to export. Servers rejected by the filter are
+// either dropped or aggregated into a single "other" server. They cannot be
+// aggregated by pool, which the stats of mcrouter do not tell.
+func (f *serverFilter) apply(servers map[string]map[string]string) map[string]map[string]string {
+	if f == nil {
+		return servers
+	}
+
+	kept := make([]string, 0, len(servers))
+	var dropped []string
+	for server := range servers {
+		if (f.include != nil && !f.include.MatchString(server)) ||
+			(f.exclude != nil && f.exclude.MatchString(server)) {
+			dropped = append(dropped, server)
+			continue
+		}
+		kept = append(kept, server)
+	}
+
+	if f.topK > 0 && len(kept) > f.topK {
+		sort.Slice(kept, func(i, j int) bool {
+			si, sj := f.score(servers[kept[i]]), f.score(servers[kept[j]])
+			if si != sj {
+				return si > sj
+			}
+			return kept[i] < kept[j]
+		})
+		dropped = append(dropped, kept[f.topK:]...)
+		kept = kept[:f.topK]
+	}
+
+	result := make(map[string]map[string]string, len(kept)+1)
+	for _, server := range kept {
+		result[server] = servers[server]
+	}
+	if f.aggregate && len(dropped) > 0 {
+		result[otherServer] = aggregateServerStats(servers, dropped)
+	}
+	return result
+}
+
+// score ranks a server for the top-k selection, higher is worse.
+func (f *serverFilter) score(metrics map[string]string) float64 {
+	return serverSorts[f.topKBy](metrics)
+}
+
+// aggregateServerStats sums the stats of the given servers, except for the
+// averages which are averaged and the extrema which keep the extremum. TKO
+// flags thus become the number of servers marked as TKO.
+func aggregateServerStats(servers map[string]map[string]string, names []string) map[string]string {
+	sums := make(map[string]float64)
+	for _, server := range names {
+		for stat := range servers[server] {
+			value := parseServerStat(servers[server], stat)
+			if extremum, ok := extremeServerStats[stat]; ok {
+				if sum, seen := sums[stat]; seen {
+					value = extremum(sum, value)
+				}
+				sums[stat] = value
+				continue
+			}
+			sums[stat] += value
+		}
+	}
+
+	result := make(map[string]string, len(sums))
+	for stat, sum := range sums {
+		if averagedServerStats[stat] {
+			sum /= float64(len(names))
+		}
+		result[stat] = strconv.FormatFloat(sum, 'f', -1, 64)
+	}
+	return result
+}
+
+// parseServerStat returns a per-server stat as a float, or 0 when it is
+// missing or malformed.
+func parseServerStat(metrics map[string]string, stat string) float64 {
+	v, err := strconv.ParseFloat(metrics[stat], 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func init() {
+	registerCollector("servers", false, "Collect per-server metrics from stats servers.", func(e *Exporter) collector {
+		return &serversCollector{e: e}
+	})
+}
+
+// serversCollector delivers the per-server metrics, optionally filtered by
+// the serverFilter of the exporter.
+type serversCollector struct {
+	e *Exporter
+}
+
+func (c *serversCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- c.e.serverDuration
+	ch <- c.e.serverProxyReqsProcessing
+	ch <- c.e.serverProxyInflightReqs
+	ch <- c.e.serverProxyRetransRatio
+	ch <- c.e.serverRetransRatio
+	ch <- c.e.serverConnections
+	ch <- c.e.serverMemcachedStored
+	ch <- c.e.serverMemcachedNotStored
+	ch <- c.e.serverMemcachedFound
+	ch <- c.e.serverMemcachedNotFound
+	ch <- c.e.serverMemcachedDeleted
+	ch <- c.e.serverMemcachedTouched
+	ch <- c.e.serverMemcachedExists
+	ch <- c.e.serverMemcachedRemoteError
+	ch <- c.e.serverMemcachedConnectTimeout
+	ch <- c.e.serverMemcachedTimeout
+	ch <- c.e.serverMemcachedSoftTKO
+	ch <- c.e.serverMemcachedHardTKO
+}
+
+func (c *serversCollector) commands() []string {
+	return []string{"stats servers"}
+}
+
+func (c *serversCollector) update(reader *bufio.Reader, stats map[string]string, ch chan<- prometheus.Metric) error {
+	servers, err := parseServerStats(reader, "stats servers")
+	if err != nil {
+		return err
+	}
+
+	for server, metrics := range c.e.serverFilter.apply(servers) {
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverDuration, prometheus.GaugeValue, c.e.parse(metrics, "avg_latency_us"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverProxyReqsProcessing, prometheus.GaugeValue, c.e.parse(metrics, "pending_reqs"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverProxyInflightReqs, prometheus.GaugeValue, c.e.parse(metrics, "inflight_reqs"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverProxyRetransRatio, prometheus.GaugeValue, c.e.parse(metrics, "avg_retrans_ratio"), server)
+		for _, stat := range []string{"avg", "min", "max"} {
+			ch <- prometheus.MustNewConstMetric(
+				c.e.serverRetransRatio, prometheus.GaugeValue, c.e.parse(metrics, stat+"_retrans_ratio"), server, stat)
+		}
+		for _, state := range []string{"closed", "down", "new", "up"} {
+			ch <- prometheus.MustNewConstMetric(
+				c.e.serverConnections, prometheus.GaugeValue, c.e.parse(metrics, state), server, state)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedStored, prometheus.CounterValue, c.e.parse(metrics, "stored"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedNotStored, prometheus.CounterValue, c.e.parse(metrics, "notstored"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedFound, prometheus.CounterValue, c.e.parse(metrics, "found"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedNotFound, prometheus.CounterValue, c.e.parse(metrics, "notfound"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedDeleted, prometheus.CounterValue, c.e.parse(metrics, "deleted"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedTouched, prometheus.CounterValue, c.e.parse(metrics, "touched"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedExists, prometheus.CounterValue, c.e.parse(metrics, "exists"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedRemoteError, prometheus.CounterValue, c.e.parse(metrics, "remote_error"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedConnectTimeout, prometheus.CounterValue, c.e.parse(metrics, "connect_timeout"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedTimeout, prometheus.CounterValue, c.e.parse(metrics, "timeout"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedSoftTKO, prometheus.GaugeValue, c.e.parse(metrics, "soft_tko"), server)
+		ch <- prometheus.MustNewConstMetric(
+			c.e.serverMemcachedHardTKO, prometheus.GaugeValue, c.e.parse(metrics, "hard_tko"), server)
+	}
+	return nil
+}
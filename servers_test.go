@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServerFilter(t *testing.T) {
+	Convey("Given the per-server stats of three servers", t, func() {
+		servers := map[string]map[string]string{
+			"10.1.1.1:11211": {"avg_latency_us": "100", "found": "10", "remote_error": "0", "soft_tko": "0", "hard_tko": "0"},
+			"10.1.1.2:11211": {"avg_latency_us": "300", "found": "20", "remote_error": "1", "soft_tko": "0", "hard_tko": "0"},
+			"10.1.2.1:11211": {"avg_latency_us": "200", "found": "30", "remote_error": "5", "soft_tko": "0", "hard_tko": "1"},
+		}
+
+		Convey("A nil filter should keep all servers", func() {
+			var f *serverFilter
+			So(f.apply(servers), ShouldResemble, servers)
+		})
+
+		Convey("An include regex should drop the other servers", func() {
+			f, err := newServerFilter(`^10\.1\.1\.`, "", 0, "latency", false)
+			So(err, ShouldBeNil)
+			So(f.apply(servers), ShouldHaveLength, 2)
+			So(f.apply(servers), ShouldNotContainKey, "10.1.2.1:11211")
+		})
+
+		Convey("An exclude regex should aggregate the other servers when requested", func() {
+			f, err := newServerFilter("", `^10\.1\.1\.`, 0, "latency", true)
+			So(err, ShouldBeNil)
+			result := f.apply(servers)
+			So(result, ShouldHaveLength, 2)
+			So(result[otherServer], ShouldResemble, map[string]string{
+				"avg_latency_us": "200", "found": "30", "remote_error": "1", "soft_tko": "0", "hard_tko": "0",
+			})
+		})
+
+		Convey("Aggregated retransmission ratios should keep their extrema", func() {
+			ratios := map[string]map[string]string{
+				"a": {"avg_retrans_ratio": "0.25", "max_retrans_ratio": "0.5", "min_retrans_ratio": "0.1"},
+				"b": {"avg_retrans_ratio": "0.75", "max_retrans_ratio": "0.9", "min_retrans_ratio": "0.3"},
+			}
+			So(aggregateServerStats(ratios, []string{"a", "b"}), ShouldResemble, map[string]string{
+				"avg_retrans_ratio": "0.5", "max_retrans_ratio": "0.9", "min_retrans_ratio": "0.1",
+			})
+		})
+
+		Convey("Top-k should keep the worst servers by the chosen ranking", func() {
+			for by, expected := range map[string]string{
+				"latency": "10.1.1.2:11211",
+				"errors":  "10.1.2.1:11211",
+				"tko":     "10.1.2.1:11211",
+			} {
+				f, err := newServerFilter("", "", 1, by, false)
+				So(err, ShouldBeNil)
+				result := f.apply(servers)
+				So(result, ShouldHaveLength, 1)
+				So(result, ShouldContainKey, expected)
+			}
+		})
+
+		Convey("Invalid options should be rejected", func() {
+			_, err := newServerFilter("(", "", 0, "latency", false)
+			So(err, ShouldNotBeNil)
+			_, err = newServerFilter("", "", 1, "qps", false)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
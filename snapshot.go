@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// snapshot holds the raw stats of a mcrouter at a point in time, as printed
+// by `scrape -format json` and compared by `diff`.
+type snapshot struct {
+	Target string    `json:"target"`
+	Time   time.Time `json:"time"`
+	// Reply to stats all.
+	Stats map[string]string `json:"stats"`
+	// Reply to stats servers, by server.
+	Servers map[string]map[string]string `json:"servers"`
+}
+
+// takeSnapshot gets the stats of the mcrouter at target over a new
+// connection, within timeout.
+func takeSnapshot(target string, timeout time.Duration) (*snapshot, error) {
+	pool := newConnPool(target, timeout)
+	defer pool.close()
+	return pool.snapshot()
+}
+
+// snapshot gets the stats of mcrouter over a connection of the pool.
+func (p *connPool) snapshot() (*snapshot, error) {
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	var stats map[string]string
+	var servers map[string]map[string]string
+	if err = c.SetDeadline(time.Now().Add(p.timeout)); err == nil {
+		if err = c.send("stats all", "stats servers"); err == nil {
+			if stats, err = parseStats(c.reader, "stats all"); err == nil {
+				servers, err = parseServerStats(c.reader, "stats servers")
+			}
+		}
+	}
+	p.put(c, err)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{Target: p.address, Time: time.Now().UTC(), Stats: stats, Servers: servers}, nil
+}
+
+// readSnapshot reads a snapshot saved by `scrape -format json`.
+func readSnapshot(path string) (*snapshot, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(content, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
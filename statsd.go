@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Keep packets below the typical Ethernet MTU, as recommended for DogStatsD.
+const statsdMaxPacketSize = 1432
+
+// Metrics sent to DogStatsD as counters. Several mcrouter stats are exposed
+// as Prometheus counters although they are levels or rates, such as the
+// memory usage, the number of clients or the outgoing request rates, and
+// are sent as gauges: only the cumulative counts of mcrouter and the
+// counters of the exporter are listed.
+var statsdCounters = map[string]bool{
+	namespace + "_asynclog_requests":                      true,
+	namespace + "_command_count":                          true,
+	namespace + "_config_failures":                        true,
+	namespace + "_config_reloads_total":                   true,
+	namespace + "_cpu_seconds_total":                      true,
+	namespace + "_dev_null_requests":                      true,
+	namespace + "_request_count":                          true,
+	namespace + "_restarts_total":                         true,
+	namespace + "_result_all_count":                       true,
+	namespace + "_result_count":                           true,
+	namespace + "_server_memcached_connect_timeout_count": true,
+	namespace + "_server_memcached_deleted_count":         true,
+	namespace + "_server_memcached_exists_count":          true,
+	namespace + "_server_memcached_found_count":           true,
+	namespace + "_server_memcached_not_found_count":       true,
+	namespace + "_server_memcached_not_stored_count":      true,
+	namespace + "_server_memcached_remote_error_count":    true,
+	namespace + "_server_memcached_stored_count":          true,
+	namespace + "_server_memcached_timeout_count":         true,
+	namespace + "_server_memcached_touched_count":         true,
+	namespace + "_server_tko_seconds_total":               true,
+	namespace + "_server_tko_transitions_total":           true,
+}
+
+// statsdPusher sends metrics to a DogStatsD agent over UDP. Gauges are sent
+// as they are, while the counters of statsdCounters are sent as the delta
+// since the previous push, so the first push only records a baseline for
+// them. Metric labels, such as
+// the per-server label, are sent as tags.
+type statsdPusher struct {
+	address string
+	tags    []string
+
+	// Counter values seen during the previous push, keyed by series.
+	last map[string]float64
+}
+
+func newStatsdPusher(address string, tags []string) *statsdPusher {
+	return &statsdPusher{
+		address: address,
+		tags:    tags,
+		last:    make(map[string]float64),
+	}
+}
+
+func (p *statsdPusher) push(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	lines := p.lines(mfs)
+	if len(lines) == 0 {
+		return nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", p.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacketSize {
+			if _, err := conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	_, err = conn.Write(packet)
+	return err
+}
+
+// lines converts metric families to DogStatsD datagram lines, updating the
+// counter baseline used to compute deltas.
+func (p *statsdPusher) lines(mfs []*dto.MetricFamily) []string {
+	var lines []string
+	seen := make(map[string]float64)
+
+	for _, mf := range mfs {
+		name := statsdName(mf.GetName())
+		for _, m := range mf.GetMetric() {
+			tags := append([]string(nil), p.tags...)
+			for _, lp := range m.GetLabel() {
+				tags = append(tags, lp.GetName()+":"+statsdEscape(lp.GetValue()))
+			}
+
+			switch {
+			case mf.GetType() == dto.MetricType_GAUGE:
+				lines = append(lines, statsdLine(name, m.GetGauge().GetValue(), "g", tags))
+			case mf.GetType() == dto.MetricType_COUNTER && !statsdCounters[mf.GetName()]:
+				lines = append(lines, statsdLine(name, m.GetCounter().GetValue(), "g", tags))
+			case mf.GetType() == dto.MetricType_COUNTER:
+				key := name + "|" + strings.Join(tags, ",")
+				value := m.GetCounter().GetValue()
+				seen[key] = value
+
+				prev, ok := p.last[key]
+				if !ok {
+					continue
+				}
+				delta := value - prev
+				if delta < 0 {
+					// The counter was reset, e.g. mcrouter restarted.
+					delta = value
+				}
+				lines = append(lines, statsdLine(name, delta, "c", tags))
+			}
+		}
+	}
+
+	// Forget series that disappeared, e.g. removed destinations.
+	p.last = seen
+	return lines
+}
+
+// statsdName turns mcrouter_foo_bar into mcrouter.foo_bar, following the
+// dotted naming convention of Datadog metrics.
+func statsdName(name string) string {
+	return strings.Replace(name, namespace+"_", namespace+".", 1)
+}
+
+// statsdEscape removes the characters that are reserved by the DogStatsD
+// datagram format from a tag value.
+func statsdEscape(s string) string {
+	return strings.NewReplacer("|", "_", ",", "_", "\n", "_").Replace(s)
+}
+
+func statsdLine(name string, value float64, kind string, tags []string) string {
+	line := name + ":" + strconv.FormatFloat(value, 'g', -1, 64) + "|" + kind
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStatsdPush(t *testing.T) {
+	Convey("Given a DogStatsD agent and a registry", t, func() {
+		agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer agent.Close()
+
+		registry := prometheus.NewRegistry()
+		found := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "mcrouter_server_memcached_found_count"}, []string{"server"})
+		latency := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "mcrouter_server_duration_us"}, []string{"server"})
+		registry.MustRegister(found, latency)
+		found.WithLabelValues("10.1.1.1:11211").Add(10)
+		latency.WithLabelValues("10.1.1.1:11211").Set(302.5)
+
+		p := newStatsdPusher(agent.LocalAddr().String(), []string{"env:test"})
+
+		Convey("The first push should only send gauges", func() {
+			So(p.push(context.Background(), registry), ShouldBeNil)
+			buf := make([]byte, statsdMaxPacketSize)
+			n, _, err := agent.ReadFrom(buf)
+			So(err, ShouldBeNil)
+			So(string(buf[:n]), ShouldEqual, "mcrouter.server_duration_us:302.5|g|#env:test,server:10.1.1.1:11211")
+
+			Convey("Later pushes should send counters as deltas", func() {
+				found.WithLabelValues("10.1.1.1:11211").Add(5)
+				So(p.push(context.Background(), registry), ShouldBeNil)
+				n, _, err := agent.ReadFrom(buf)
+				So(err, ShouldBeNil)
+
+				lines := strings.Split(string(buf[:n]), "\n")
+				sort.Strings(lines)
+				So(lines, ShouldResemble, []string{
+					"mcrouter.server_duration_us:302.5|g|#env:test,server:10.1.1.1:11211",
+					"mcrouter.server_memcached_found_count:5|c|#env:test,server:10.1.1.1:11211",
+				})
+			})
+		})
+	})
+
+	Convey("Given an exporter scraping mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{"stats all": "STAT ps_rss 500000000\r\nSTAT cmd_get_count 42\r\nEND\r\n"})
+		defer l.Close()
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(NewExporter(l.Addr(), time.Second, false, log.NewNopLogger()))
+		mfs, err := registry.Gather()
+		So(err, ShouldBeNil)
+
+		Convey("Levels typed as counters should be sent as gauges", func() {
+			p := newStatsdPusher("127.0.0.1:0", nil)
+			lines := p.lines(mfs)
+			So(lines, ShouldContain, "mcrouter.resident_memory_bytes:5e+08|g")
+			for _, line := range lines {
+				So(line, ShouldNotStartWith, "mcrouter.command_count:")
+			}
+		})
+	})
+}
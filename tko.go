@@ -0,0 +1,237 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kinds of TKO, along with the per-server stat flagging them.
+var tkoKinds = [...]struct{ kind, stat string }{
+	{"soft", softTKOState},
+	{"hard", hardTKOState},
+}
+
+var (
+	tkoTransitionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "server_tko_transitions_total"),
+		"Number of times the server was marked as TKO, observed by the background polling (per-server metric).",
+		[]string{"server", "kind"},
+		nil,
+	)
+	tkoSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "server_tko_seconds_total"),
+		"Number of seconds the server was marked as TKO, observed by the background polling (per-server metric).",
+		[]string{"server", "kind"},
+		nil,
+	)
+)
+
+// tkoTransition is a server being marked as TKO or recovering.
+type tkoTransition struct {
+	Time   time.Time
+	Target string
+	Server string
+	Kind   string
+	// Whether the server was marked as TKO, false when it recovered.
+	TKO bool
+	// Duration of the TKO episode that ended when the server recovered.
+	Duration time.Duration
+}
+
+// tkoServer is the TKO state of a polled server, for each kind.
+type tkoServer struct {
+	// Time the server was marked as TKO, zero when it is not.
+	since       [len(tkoKinds)]time.Time
+	transitions [len(tkoKinds)]float64
+	seconds     [len(tkoKinds)]float64
+}
+
+// tkoTracker detects the TKO transitions of the servers by comparing their
+// stats across polls.
+type tkoTracker struct {
+	mu       sync.Mutex
+	lastPoll time.Time
+	servers  map[string]*tkoServer
+
+	// Filter of the per-server metrics, and the servers it kept on the last
+	// poll, nil when there is no filter.
+	filter *serverFilter
+	kept   map[string]bool
+	// Transitions and TKO time of the servers while they were aggregated by
+	// the filter, nil until a server is.
+	other *tkoServer
+
+	// Ring buffer of the recent transitions, next being the index of the
+	// slot to overwrite once it is full.
+	history []tkoTransition
+	size    int
+	next    int
+}
+
+func newTKOTracker(size int, filter *serverFilter) *tkoTracker {
+	return &tkoTracker{servers: make(map[string]*tkoServer), filter: filter, size: size}
+}
+
+// observe records the TKO flags of the servers polled at the given time. The
+// servers found TKO by the first poll are tracked without counting a
+// transition, since it happened before. Servers that are gone are dropped,
+// along with their TKO episode. The counts of the servers aggregated by the
+// filter are also added to the "other" server, which thus never decreases
+// as servers move in and out of it.
+func (t *tkoTracker) observe(servers map[string]map[string]string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.filter != nil {
+		t.kept = make(map[string]bool)
+		for server := range t.filter.apply(servers) {
+			t.kept[server] = true
+		}
+	}
+
+	for server, stats := range servers {
+		st := t.servers[server]
+		if st == nil {
+			// Start at zero, so that the first transition is a counter increase
+			st = &tkoServer{}
+			t.servers[server] = st
+		}
+		aggregated := t.kept != nil && !t.kept[server] && t.filter.aggregate
+		if aggregated && t.other == nil {
+			t.other = &tkoServer{}
+		}
+
+		for i, k := range tkoKinds {
+			tko := stats[k.stat] == "1"
+			wasTKO := !st.since[i].IsZero()
+			var seconds, transitions float64
+			if wasTKO {
+				seconds = now.Sub(t.lastPoll).Seconds()
+			}
+			switch {
+			case tko && !wasTKO:
+				st.since[i] = now
+				if !t.lastPoll.IsZero() {
+					transitions = 1
+					t.record(tkoTransition{Time: now, Server: server, Kind: k.kind, TKO: true})
+				}
+			case !tko && wasTKO:
+				t.record(tkoTransition{Time: now, Server: server, Kind: k.kind, Duration: now.Sub(st.since[i])})
+				st.since[i] = time.Time{}
+			}
+			st.seconds[i] += seconds
+			st.transitions[i] += transitions
+			if aggregated {
+				t.other.seconds[i] += seconds
+				t.other.transitions[i] += transitions
+			}
+		}
+	}
+	for server := range t.servers {
+		if _, ok := servers[server]; !ok {
+			delete(t.servers, server)
+		}
+	}
+	t.lastPoll = now
+}
+
+func (t *tkoTracker) record(transition tkoTransition) {
+	if t.size <= 0 {
+		return
+	}
+	if len(t.history) < t.size {
+		t.history = append(t.history, transition)
+		return
+	}
+	t.history[t.next] = transition
+	t.next = (t.next + 1) % t.size
+}
+
+// recent returns the recent transitions, oldest first.
+func (t *tkoTracker) recent() []tkoTransition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append(append([]tkoTransition(nil), t.history[t.next:]...), t.history[:t.next]...)
+}
+
+// collect delivers the TKO transitions and durations of the servers kept by
+// the filter, and of the "other" server when the filter aggregates the
+// others.
+func (t *tkoTracker) collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	send := func(server string, st *tkoServer) {
+		for i, k := range tkoKinds {
+			ch <- prometheus.MustNewConstMetric(tkoTransitionsDesc, prometheus.CounterValue, st.transitions[i], server, k.kind)
+			ch <- prometheus.MustNewConstMetric(tkoSecondsDesc, prometheus.CounterValue, st.seconds[i], server, k.kind)
+		}
+	}
+	for server, st := range t.servers {
+		if t.kept == nil || t.kept[server] {
+			send(server, st)
+		}
+	}
+	if t.other != nil {
+		send(otherServer, t.other)
+	}
+}
+
+var tkoTemplate = template.Must(template.New("tko").Parse(`<html>
+             <head><title>Mcrouter Exporter - TKO Transitions</title></head>
+             <body>
+             <h1>TKO Transitions</h1>
+             {{if .}}
+             <table border="1">
+             <tr><th>Time</th><th>Target</th><th>Server</th><th>Kind</th><th>Transition</th><th>TKO duration</th></tr>
+             {{range .}}<tr><td>{{.Time.Format "2006-01-02T15:04:05.000Z07:00"}}</td><td>{{.Target}}</td><td>{{.Server}}</td><td>{{.Kind}}</td>
+             <td>{{if .TKO}}marked TKO{{else}}recovered{{end}}</td><td>{{if not .TKO}}{{.Duration}}{{end}}</td></tr>
+             {{end}}
+             </table>
+             {{else}}
+             <p>No TKO transition observed.</p>
+             {{end}}
+             </body>
+             </html>`))
+
+// writeTKOTransitions renders the transitions, newest first.
+func writeTKOTransitions(w http.ResponseWriter, transitions []tkoTransition) error {
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].Time.After(transitions[j].Time)
+	})
+	return tkoTemplate.Execute(w, transitions)
+}
+
+// tkoHandler lists the recent TKO transitions observed by the background
+// polling.
+func (e *Exporter) tkoHandler(w http.ResponseWriter, r *http.Request) {
+	if err := writeTKOTransitions(w, e.tko.recent()); err != nil {
+		level.Error(e.logger).Log("msg", "Failed to render TKO page", "err", err)
+	}
+}
+
+// tkoHandler lists the recent TKO transitions of every target.
+func (f *fleet) tkoHandler(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	var transitions []tkoTransition
+	for address, t := range f.targets {
+		if t.exporter.tko == nil {
+			continue
+		}
+		for _, transition := range t.exporter.tko.recent() {
+			transition.Target = address
+			transitions = append(transitions, transition)
+		}
+	}
+	f.mu.Unlock()
+
+	if err := writeTKOTransitions(w, transitions); err != nil {
+		level.Error(f.logger).Log("msg", "Failed to render TKO page", "err", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// tkoCollector exposes the metrics of a TKO tracker
+type tkoCollector struct{ t *tkoTracker }
+
+func (c tkoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tkoTransitionsDesc
+	ch <- tkoSecondsDesc
+}
+func (c tkoCollector) Collect(ch chan<- prometheus.Metric) { c.t.collect(ch) }
+
+func TestTKOTransitions(t *testing.T) {
+	Convey("Given TKO flags polled over time", t, func() {
+		tracker := newTKOTracker(3, nil)
+		start := time.Unix(1700000000, 0)
+		poll := func(seconds int, flags map[string]string) {
+			servers := map[string]map[string]string{"10.0.0.2:11211": {softTKOState: "0", hardTKOState: "0"}}
+			servers["10.0.0.1:11211"] = map[string]string{softTKOState: "0", hardTKOState: "0"}
+			for stat, value := range flags {
+				servers["10.0.0.1:11211"][stat] = value
+			}
+			tracker.observe(servers, start.Add(time.Duration(seconds)*time.Second))
+		}
+
+		poll(0, nil)
+		poll(1, map[string]string{softTKOState: "1"})
+		poll(2, map[string]string{softTKOState: "1"})
+		poll(3, nil)
+
+		Convey("It should count the transitions and the TKO time of the flapping server", func() {
+			So(tracker.servers["10.0.0.2:11211"], ShouldResemble, &tkoServer{})
+			st := tracker.servers["10.0.0.1:11211"]
+			So(st.transitions, ShouldResemble, [2]float64{1, 0})
+			So(st.seconds, ShouldResemble, [2]float64{2, 0})
+		})
+
+		Convey("It should keep the transitions in order", func() {
+			So(tracker.recent(), ShouldResemble, []tkoTransition{
+				{Time: start.Add(time.Second), Server: "10.0.0.1:11211", Kind: "soft", TKO: true},
+				{Time: start.Add(3 * time.Second), Server: "10.0.0.1:11211", Kind: "soft", Duration: 2 * time.Second},
+			})
+		})
+
+		Convey("It should only keep the most recent transitions", func() {
+			poll(4, map[string]string{hardTKOState: "1"})
+			poll(5, nil)
+			recent := tracker.recent()
+			So(recent, ShouldHaveLength, 3)
+			So(recent[0].Time, ShouldEqual, start.Add(3*time.Second))
+			So(recent[2].Time, ShouldEqual, start.Add(5*time.Second))
+			So(tracker.servers["10.0.0.1:11211"].transitions, ShouldResemble, [2]float64{1, 1})
+		})
+	})
+
+	Convey("A server already TKO on the first poll should not count as a transition", t, func() {
+		tracker := newTKOTracker(10, nil)
+		tracker.observe(map[string]map[string]string{"10.0.0.1:11211": {hardTKOState: "1"}}, time.Unix(0, 0))
+		tracker.observe(map[string]map[string]string{"10.0.0.1:11211": {hardTKOState: "1"}}, time.Unix(5, 0))
+		So(tracker.servers["10.0.0.1:11211"].transitions, ShouldResemble, [2]float64{0, 0})
+		So(tracker.servers["10.0.0.1:11211"].seconds, ShouldResemble, [2]float64{0, 5})
+		So(tracker.recent(), ShouldBeEmpty)
+	})
+
+	Convey("A server removed while TKO should be dropped", t, func() {
+		tracker := newTKOTracker(10, nil)
+		tracker.observe(map[string]map[string]string{"10.0.0.1:11211": {softTKOState: "0"}}, time.Unix(0, 0))
+		tracker.observe(map[string]map[string]string{"10.0.0.1:11211": {softTKOState: "1"}}, time.Unix(1, 0))
+		tracker.observe(map[string]map[string]string{}, time.Unix(2, 0))
+		So(tracker.servers, ShouldBeEmpty)
+
+		Convey("And coming back healthy should not record a recovery", func() {
+			tracker.observe(map[string]map[string]string{"10.0.0.1:11211": {softTKOState: "0"}}, time.Unix(600, 0))
+			So(tracker.servers["10.0.0.1:11211"], ShouldResemble, &tkoServer{})
+			So(tracker.recent(), ShouldHaveLength, 1)
+			So(tracker.recent()[0].TKO, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given TKO servers and a per-server metrics filter", t, func() {
+		servers := map[string]map[string]string{
+			"10.0.0.1:11211": {softTKOState: "1"},
+			"10.0.0.2:11211": {hardTKOState: "1"},
+			"10.0.0.3:11211": {softTKOState: "1"},
+		}
+		observe := func(filter *serverFilter) map[string]float64 {
+			tracker := newTKOTracker(10, filter)
+			tracker.observe(map[string]map[string]string{}, time.Unix(0, 0))
+			tracker.observe(servers, time.Unix(1, 0))
+			return gatherValues(t, tkoCollector{tracker})
+		}
+
+		Convey("Servers should be exported at zero before their first transition", func() {
+			tracker := newTKOTracker(10, nil)
+			tracker.observe(map[string]map[string]string{"10.0.0.4:11211": {}}, time.Unix(0, 0))
+			values := gatherValues(t, tkoCollector{tracker})
+			So(values, ShouldHaveLength, 4)
+			So(values, ShouldContainKey, namespace+`_server_tko_transitions_total{kind="soft",server="10.0.0.4:11211"}`)
+		})
+
+		Convey("Only the servers kept by the filter should be exported", func() {
+			filter, err := newServerFilter("", `^10\.0\.0\.[12]:`, 0, "latency", false)
+			So(err, ShouldBeNil)
+			values := observe(filter)
+			So(values, ShouldHaveLength, 4)
+			So(values[namespace+`_server_tko_transitions_total{kind="soft",server="10.0.0.3:11211"}`], ShouldEqual, 1)
+		})
+
+		Convey("The servers filtered out should be summed into other when aggregated", func() {
+			filter, err := newServerFilter("", `^10\.0\.0\.[12]:`, 0, "latency", true)
+			So(err, ShouldBeNil)
+			values := observe(filter)
+			So(values, ShouldHaveLength, 8)
+			So(values[namespace+`_server_tko_transitions_total{kind="soft",server="other"}`], ShouldEqual, 1)
+			So(values[namespace+`_server_tko_transitions_total{kind="hard",server="other"}`], ShouldEqual, 1)
+		})
+
+		Convey("The other server should never decrease as servers move in and out of it", func() {
+			filter, err := newServerFilter("", "", 1, "tko", true)
+			So(err, ShouldBeNil)
+			tracker := newTKOTracker(10, filter)
+			other := func() float64 {
+				return gatherValues(t, tkoCollector{tracker})[namespace+`_server_tko_transitions_total{kind="soft",server="other"}`]
+			}
+			poll := func(seconds int64, a, b string) {
+				tracker.observe(map[string]map[string]string{
+					"a": {softTKOState: a, hardTKOState: a},
+					"b": {softTKOState: b},
+				}, time.Unix(seconds, 0))
+			}
+			poll(0, "0", "0")
+			poll(1, "0", "1")
+			So(other(), ShouldEqual, 0)
+			// b recovers and a, TKO twice, becomes the worst so b moves to other
+			poll(2, "1", "0")
+			poll(3, "1", "1")
+			So(other(), ShouldEqual, 1)
+			// b recovers then goes away
+			poll(4, "1", "0")
+			tracker.observe(map[string]map[string]string{"a": {softTKOState: "1", hardTKOState: "1"}}, time.Unix(5, 0))
+			So(other(), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Given an exporter polling a flapping mcrouter", t, func() {
+		l := serveCommands(t, map[string]string{
+			"stats all":     "STAT version 37.0.0\r\nEND\r\n",
+			"stats servers": "STAT 10.0.0.1:11211:ascii:plain:notcompressed-1000 avg_latency_us:300 up:1\r\nEND\r\n",
+		})
+		defer l.Close()
+		e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+		e.tko = newTKOTracker(10, nil)
+
+		So(e.pollOnce(), ShouldBeNil)
+		l.SetReply("stats servers", "STAT 10.0.0.1:11211:ascii:plain:notcompressed-1000 avg_latency_us:300 up:1 soft_tko; found:1\r\nEND\r\n")
+		So(e.pollOnce(), ShouldBeNil)
+
+		Convey("The transition should be exported", func() {
+			values := gatherValues(t, e)
+			So(values[`mcrouter_server_tko_transitions_total{kind="soft",server="10.0.0.1:11211:ascii:plain:notcompressed-1000"}`], ShouldEqual, 1)
+			So(values, ShouldContainKey, `mcrouter_server_tko_seconds_total{kind="hard",server="10.0.0.1:11211:ascii:plain:notcompressed-1000"}`)
+		})
+
+		Convey("The transition should be listed on /debug/tko", func() {
+			w := httptest.NewRecorder()
+			e.tkoHandler(w, httptest.NewRequest("GET", "/debug/tko", nil))
+			So(w.Body.String(), ShouldContainSubstring, "<td>10.0.0.1:11211:ascii:plain:notcompressed-1000</td><td>soft</td>")
+			So(w.Body.String(), ShouldContainSubstring, "marked TKO")
+		})
+	})
+
+	Convey("Closing an exporter should stop its polling", t, func() {
+		l := serveCommands(t, map[string]string{"stats servers": "END\r\n"})
+		defer l.Close()
+		e := NewExporter(l.Addr(), time.Second, false, log.NewNopLogger())
+		e.startPolling(time.Millisecond, 10, 0)
+		time.Sleep(10 * time.Millisecond)
+		e.close()
+		lastPoll := func() time.Time {
+			e.tko.mu.Lock()
+			defer e.tko.mu.Unlock()
+			return e.tko.lastPoll
+		}
+
+		// Let a poll in flight finish
+		time.Sleep(20 * time.Millisecond)
+		polled := lastPoll()
+		So(polled.IsZero(), ShouldBeFalse)
+		time.Sleep(20 * time.Millisecond)
+		So(lastPoll(), ShouldEqual, polled)
+	})
+}
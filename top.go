@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const topHelp = "Watch the request rates and the worst destinations of a mcrouter live, in a terminal refreshed every interval."
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// topView is the state of the terminal view of top.
+type topView struct {
+	interval time.Duration
+	// Sort of the destinations, a key of serverSorts.
+	sortBy string
+	// Number of destinations listed, 0 lists all.
+	rows int
+
+	prev, last *snapshot
+	// Error of the last poll, if it failed.
+	err error
+}
+
+// update records the result of a poll. Rates are computed between the last
+// two successful polls.
+func (v *topView) update(s *snapshot, err error) {
+	if err != nil {
+		v.err = err
+		return
+	}
+	v.prev, v.last, v.err = v.last, s, nil
+}
+
+// sortKey changes the sort of the destinations to the sort named, or
+// starting with, key. It reports whether there is such a sort.
+func (v *topView) sortKey(key string) bool {
+	for name := range serverSorts {
+		if key == name || key == name[:1] {
+			v.sortBy = name
+			return true
+		}
+	}
+	return false
+}
+
+// render redraws the whole terminal in a single write, to avoid flickering.
+func (v *topView) render(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString(clearScreen)
+	if v.last == nil {
+		fmt.Fprintf(&b, "Polling mcrouter every %s...\n", v.interval)
+	} else {
+		fmt.Fprintf(&b, "%s, refreshing every %s\n", v.last.Time.Local().Format("15:04:05"), v.interval)
+		writeSummary(&b, v.prev, v.last)
+
+		var sorts []string
+		for _, name := range serverSortNames() {
+			sorts = append(sorts, fmt.Sprintf("%s(%s)", name[:1], name[1:]))
+		}
+		fmt.Fprintf(&b, "\nDestinations by %s. Sort with %s then Enter, quit with q.\n\n", v.sortBy, strings.Join(sorts, " "))
+		servers := v.last.Servers
+		if err := writeServerTable(&b, servers, rankServers(servers, serverSorts[v.sortBy], v.rows)); err != nil {
+			return err
+		}
+	}
+	if v.err != nil {
+		fmt.Fprintf(&b, "\nLast poll failed: %v\n", v.err)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// watch polls mcrouter every interval and renders the view, until the
+// context is done, q is read from keys or after iterations polls unless
+// it is 0. The other keys change the sort of the destinations.
+func (v *topView) watch(ctx context.Context, w io.Writer, pool *connPool, keys <-chan string, iterations int) error {
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+	for n := 1; ; n++ {
+		v.update(pool.snapshot())
+		if err := v.render(w); err != nil {
+			return err
+		}
+		if n == iterations {
+			return nil
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				break wait
+			case key, ok := <-keys:
+				if !ok {
+					// Standard input is closed, keep refreshing
+					keys = nil
+					continue
+				}
+				if key == "q" {
+					return nil
+				}
+				if v.sortKey(key) {
+					if err := v.render(w); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
+
+// readKeys sends the lines read from r to keys, until r is exhausted.
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		keys <- strings.TrimSpace(scanner.Text())
+	}
+}
+
+// runTop watches a mcrouter until interrupted.
+func runTop(args []string) error {
+	fs := newFlagSet("top", topHelp)
+	var (
+		target     = fs.String("target", "localhost:5000", "mcrouter server TCP address (tcp4/tcp6) or UNIX socket path.")
+		interval   = fs.Duration("interval", time.Second, "Time between two polls of mcrouter.")
+		timeout    = fs.Duration("timeout", 5*time.Second, "Timeout of a poll.")
+		sortBy     = fs.String("sort", "latency", "Initial sort of the destinations, one of: "+strings.Join(serverSortNames(), ", ")+".")
+		rows       = fs.Int("top", 20, "Number of destinations listed, 0 lists all.")
+		iterations = fs.Int("iterations", 0, "Number of polls before exiting, 0 polls until interrupted.")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, ok := serverSorts[*sortBy]; !ok {
+		return fmt.Errorf("unknown sort %q, expected one of: %s", *sortBy, strings.Join(serverSortNames(), ", "))
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %s", *interval)
+	}
+
+	pool := newConnPool(*target, *timeout)
+	defer pool.close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+
+	v := &topView{interval: *interval, sortBy: *sortBy, rows: *rows}
+	return v.watch(ctx, os.Stdout, pool, keys, *iterations)
+}
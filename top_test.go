@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTop(t *testing.T) {
+	Convey("Given a fake mcrouter 37 watched by top", t, func() {
+		s := startFakeMcrouter(t, "127.0.0.1:0", "mcrouter-37.script")
+		defer s.Close()
+		pool := newConnPool(s.Addr(), time.Second)
+		defer pool.close()
+		v := &topView{interval: time.Hour, sortBy: "latency", rows: 20}
+		var out bytes.Buffer
+
+		Convey("Each poll should redraw the summary and the destinations", func() {
+			v.interval = time.Millisecond
+			So(v.watch(context.Background(), &out, pool, nil, 3), ShouldBeNil)
+			frames := strings.Split(out.String(), clearScreen)[1:]
+			So(frames, ShouldHaveLength, 3)
+			So(frames[2], ShouldContainSubstring, "Requests: 3 processing, 1 waiting")
+			So(frames[2], ShouldContainSubstring, "Destinations by latency.")
+			So(frames[2], ShouldContainSubstring, "10.0.0.2:11211:ascii:plain:notcompressed-1000  1503.4")
+		})
+
+		Convey("Typed keys should change the sort until q quits", func() {
+			keys := make(chan string, 3)
+			keys <- "p"
+			keys <- "x"
+			keys <- "q"
+			So(v.watch(context.Background(), &out, pool, keys, 0), ShouldBeNil)
+			frames := strings.Split(out.String(), clearScreen)[1:]
+			So(frames, ShouldHaveLength, 2)
+			So(frames[1], ShouldContainSubstring, "Destinations by pending.")
+		})
+
+		Convey("A done context should stop it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(v.watch(ctx, &out, pool, nil, 0), ShouldBeNil)
+		})
+	})
+
+	Convey("Given two snapshots 2 seconds apart", t, func() {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		v := &topView{interval: time.Second, sortBy: "tko"}
+		v.update(&snapshot{Time: start, Stats: map[string]string{"cmd_get": "1", "cmd_get_count": "100", "result_tko": "1", "result_tko_count": "10"}}, nil)
+		v.update(&snapshot{Time: start.Add(2 * time.Second), Stats: map[string]string{"cmd_get": "1", "cmd_get_count": "300", "result_tko": "1", "result_tko_count": "5"},
+			Servers: map[string]map[string]string{
+				"s1": {"avg_latency_us": "900"},
+				"s2": {"avg_latency_us": "100", softTKOState: "1"},
+			}}, nil)
+
+		Convey("Rates should come from the counters, unless they were reset", func() {
+			var out bytes.Buffer
+			So(v.render(&out), ShouldBeNil)
+			So(out.String(), ShouldContainSubstring, "Commands/s: get 100\n")
+			So(out.String(), ShouldContainSubstring, "Errors/s: tko 1\n")
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			So(strings.Fields(lines[len(lines)-2]), ShouldResemble, []string{"s2", "100", "-", "-", "-", "soft", "0"})
+			So(strings.Fields(lines[len(lines)-1])[0], ShouldEqual, "s1")
+		})
+
+		Convey("A failed poll should keep the last stats along with the error", func() {
+			v.update(nil, errors.New("connection refused"))
+			var out bytes.Buffer
+			So(v.render(&out), ShouldBeNil)
+			So(out.String(), ShouldContainSubstring, "Commands/s: get 100\n")
+			So(out.String(), ShouldContainSubstring, "Last poll failed: connection refused\n")
+		})
+	})
+}